@@ -0,0 +1,168 @@
+package graylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AckTracker numbers messages with a _sequence field, and tracks which
+// were acknowledged by the GELF HTTP input, that is answered 202
+// Accepted, for at-least-once audit logging.  The checkpoint it reports
+// is persisted by the caller, and passed back on restart so that the
+// numbering resumes after it.
+//
+// Number goes in front of the retry path and Track behind it, right
+// before the HTTP transport, so that a failed message is acknowledged
+// once a retry succeeds:
+//
+//	w, err := graylog.NewWriter("https://graylog.example.com/gelf")
+//	acks := graylog.NewAckTracker(loadCheckpoint())
+//	w.Use(acks.Track())
+//	buf, err := graylog.NewDiskBuffer(w.Transport, "/var/lib/app/gelf.buf", 64<<20)
+//	w.Transport = buf
+//	w.Use(acks.Number())
+//
+// Over UDP, a successful send says nothing about delivery.
+type AckTracker struct {
+	mu         sync.Mutex
+	next       uint64
+	checkpoint uint64
+	acked      map[uint64]struct{} // acknowledged after a gap
+
+	lastSent uint64 // by DetectGaps
+	failing  bool
+}
+
+// NewAckTracker returns a tracker numbering messages from checkpoint+1,
+// checkpoint being the last one acknowledged by a previous run, or 0.
+func NewAckTracker(checkpoint uint64) *AckTracker {
+	return &AckTracker{next: checkpoint + 1, checkpoint: checkpoint, acked: make(map[uint64]struct{})}
+}
+
+// sequenceKey is the field holding the sequence number of a message.
+func sequenceKey() string {
+	return AdditionalFieldPrefix + "sequence"
+}
+
+// Number returns a middleware numbering the messages which aren't yet.
+func (a *AckTracker) Number() TransportMiddleware {
+	return func(next Transport) Transport {
+		return TransportFunc(func(m *Message) error {
+			if _, ok := m.Extra[sequenceKey()]; !ok {
+				a.mu.Lock()
+				seq := a.next
+				a.next++
+				a.mu.Unlock()
+				m.setExtra(sequenceKey(), seq)
+			}
+			return next.WriteMessage(m)
+		})
+	}
+}
+
+// Track returns a middleware acknowledging the numbered messages next
+// sends without error.
+func (a *AckTracker) Track() TransportMiddleware {
+	return func(next Transport) Transport {
+		return TransportFunc(func(m *Message) error {
+			err := next.WriteMessage(m)
+			if err == nil {
+				if seq, ok := sequenceOf(m); ok {
+					a.ack(seq)
+				}
+			}
+			return err
+		})
+	}
+}
+
+// DetectGaps returns a middleware marking outages of the transport next
+// in Graylog: once a numbered message is sent again after failures, it
+// sends a warning with _sequence_gap_detected, and the sequence numbers
+// of the last message sent before the failures and the first one sent
+// after as _sequence_gap_from and _sequence_gap_to.  The messages in
+// between may have been lost, as well as, over TCP, some sent just
+// before the connection broke.  Like Track, it goes behind Number.
+func (a *AckTracker) DetectGaps() TransportMiddleware {
+	return func(next Transport) Transport {
+		return TransportFunc(func(m *Message) error {
+			err := next.WriteMessage(m)
+			seq, ok := sequenceOf(m)
+			if !ok {
+				return err
+			}
+
+			a.mu.Lock()
+			from, recovered := a.lastSent, err == nil && a.failing
+			if err != nil {
+				a.failing = true
+			} else {
+				a.failing = false
+				if seq > a.lastSent {
+					a.lastSent = seq
+				}
+			}
+			a.mu.Unlock()
+
+			if recovered {
+				next.WriteMessage(&Message{
+					Version:  m.Version,
+					Host:     m.Host,
+					Short:    fmt.Sprintf("gelf: messages between sequence numbers %d and %d may have been lost", from, seq),
+					TimeUnix: float64(time.Now().UnixNano()/1000000) / 1000.,
+					Level:    4, // warning
+					Facility: m.Facility,
+					Extra: map[string]interface{}{
+						AdditionalFieldPrefix + "sequence_gap_detected": true,
+						AdditionalFieldPrefix + "sequence_gap_from":     from,
+						AdditionalFieldPrefix + "sequence_gap_to":       seq,
+					},
+				})
+			}
+			return err
+		})
+	}
+}
+
+// ack records the acknowledgment of seq, advancing the checkpoint over
+// the messages acknowledged without gap.
+func (a *AckTracker) ack(seq uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if seq <= a.checkpoint {
+		return
+	}
+	a.acked[seq] = struct{}{}
+	for {
+		if _, ok := a.acked[a.checkpoint+1]; !ok {
+			break
+		}
+		a.checkpoint++
+		delete(a.acked, a.checkpoint)
+	}
+}
+
+// Checkpoint returns the sequence number up to which every message was
+// acknowledged.  A message nacked and never retried holds it back.
+func (a *AckTracker) Checkpoint() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.checkpoint
+}
+
+// sequenceOf returns the sequence number of a message, which is a
+// float64 once replayed from a DiskBuffer.
+func sequenceOf(m *Message) (uint64, bool) {
+	switch seq := m.Extra[sequenceKey()].(type) {
+	case uint64:
+		return seq, true
+	case float64:
+		return uint64(seq), seq >= 0
+	case json.Number:
+		n, err := seq.Int64()
+		return uint64(n), err == nil && n >= 0
+	}
+	return 0, false
+}
@@ -0,0 +1,162 @@
+package graylog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// ackServer is a GELF HTTP input which can be made to fail.
+type ackServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	seqs   []float64
+}
+
+func newAckServer() *ackServer {
+	s := &ackServer{status: http.StatusAccepted}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m Message
+		json.NewDecoder(r.Body).Decode(&m)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.status == http.StatusAccepted {
+			seq, _ := m.Extra["_sequence"].(float64)
+			s.seqs = append(s.seqs, seq)
+		}
+		w.WriteHeader(s.status)
+	}))
+	return s
+}
+
+func (s *ackServer) setStatus(status int) {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+}
+
+func TestAckTracker(t *testing.T) {
+	s := newAckServer()
+	defer s.Close()
+	w, err := NewWriter(s.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	acks := NewAckTracker(0)
+	w.Use(acks.Number(), acks.Track())
+
+	w.Write([]byte("first"))
+	w.Write([]byte("second"))
+	if ck := acks.Checkpoint(); ck != 2 {
+		t.Errorf("expected both messages acknowledged, got checkpoint %d", ck)
+	}
+
+	s.setStatus(http.StatusServiceUnavailable)
+	if _, err := w.Write([]byte("nacked")); err == nil {
+		t.Error("expected the failure")
+	}
+	s.setStatus(http.StatusAccepted)
+	w.Write([]byte("fourth"))
+	if ck := acks.Checkpoint(); ck != 2 {
+		t.Errorf("a nacked message should hold the checkpoint back, got %d", ck)
+	}
+}
+
+func TestAckTrackerRetry(t *testing.T) {
+	path, cleanup := newBufferDir(t)
+	defer cleanup()
+	s := newAckServer()
+	defer s.Close()
+
+	w, err := NewWriter(s.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	acks := NewAckTracker(0)
+	w.Use(acks.Track())
+	buf, err := NewDiskBuffer(w.Transport, path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewDiskBuffer: %s", err)
+	}
+	w.Transport = buf
+	w.Use(acks.Number())
+	defer w.Close()
+
+	w.Write([]byte("first"))
+	s.setStatus(http.StatusServiceUnavailable)
+	w.Write([]byte("buffered"))
+	w.Write([]byte("also buffered"))
+	if ck := acks.Checkpoint(); ck != 1 {
+		t.Errorf("expected the messages sent during the outage not acknowledged, got checkpoint %d", ck)
+	}
+
+	s.setStatus(http.StatusAccepted)
+	if err := buf.Replay(); err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	if ck := acks.Checkpoint(); ck != 3 {
+		t.Errorf("expected the replayed messages acknowledged, got checkpoint %d", ck)
+	}
+
+	// the process restarts from the persisted checkpoint
+	acks = NewAckTracker(acks.Checkpoint())
+	w2, err := NewWriter(s.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w2.Use(acks.Number(), acks.Track())
+	w2.Write([]byte("after restart"))
+	if ck := acks.Checkpoint(); ck != 4 {
+		t.Errorf("expected the numbering to resume, got checkpoint %d", ck)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, seq := range s.seqs {
+		if seq != float64(i+1) {
+			t.Errorf("expected every message delivered once in order, got %v", s.seqs)
+			break
+		}
+	}
+}
+
+func TestDetectGaps(t *testing.T) {
+	w, _ := newCaptureWriter()
+	ft := &flakyTransport{}
+	w.Transport = ft
+	acks := NewAckTracker(0)
+	w.Use(acks.Number(), acks.DetectGaps())
+
+	w.Write([]byte("first"))
+	w.Write([]byte("second"))
+	ft.setDown(true)
+	if _, err := w.Write([]byte("lost")); err != errOutage {
+		t.Fatalf("expected the outage, got %v", err)
+	}
+	w.Write([]byte("lost too"))
+	ft.setDown(false)
+	w.Write([]byte("recovered"))
+	w.Write([]byte("after"))
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if len(ft.msgs) != 5 {
+		t.Fatalf("expected a single diagnostic after the recovery, got %d messages", len(ft.msgs))
+	}
+	gap := ft.msgs[3]
+	if gap.Extra["_sequence_gap_detected"] != true || gap.Extra["_sequence_gap_from"] != uint64(2) || gap.Extra["_sequence_gap_to"] != uint64(5) {
+		t.Errorf("expected the gap between the second and the recovered message, got %v", gap.Extra)
+	}
+	if gap.Short != "gelf: messages between sequence numbers 2 and 5 may have been lost" || gap.Host != "testing.local" || gap.Level != 4 {
+		t.Errorf("unexpected diagnostic: %+v", gap)
+	}
+	if _, ok := gap.Extra["_sequence"]; ok {
+		t.Errorf("the diagnostic should not be numbered")
+	}
+	if ft.msgs[2].Short != "recovered" || ft.msgs[4].Short != "after" {
+		t.Errorf("expected the diagnostic right after the recovered message, got %q and %q", ft.msgs[2].Short, ft.msgs[4].Short)
+	}
+}
@@ -0,0 +1,91 @@
+package graylog
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// AMQPPublisher publishes a message body to an AMQP exchange, typically
+// over a RabbitMQ channel of the application in confirm mode, returning
+// once the broker confirmed it.  Publishers implementing io.Closer, like
+// a channel along with its connection, are closed when dropped.
+type AMQPPublisher interface {
+	Publish(exchange, routingKey string, body []byte) error
+}
+
+// AMQPTransport publishes messages to an exchange bound to the queue of a
+// Graylog GELF AMQP input, each as the body of a JSON message, so that
+// RabbitMQ buffers the logs while Graylog is down for maintenance:
+//
+//	t, err := graylog.NewAMQPTransport(dialRabbitMQ, "log-messages", "gelf")
+//	w := graylog.NewTransportWriter(t)
+//
+// A publisher failing is dropped, and dial called again for the next
+// message, to recover from broken connections and closed channels.
+type AMQPTransport struct {
+	Exchange   string
+	RoutingKey string
+
+	mu     sync.Mutex
+	dial   func() (AMQPPublisher, error)
+	pub    AMQPPublisher
+	closed bool
+}
+
+// NewAMQPTransport returns a transport publishing to exchange with the
+// given routing key, through the publishers returned by dial, which is
+// called right away.
+func NewAMQPTransport(dial func() (AMQPPublisher, error), exchange, routingKey string) (*AMQPTransport, error) {
+	pub, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &AMQPTransport{Exchange: exchange, RoutingKey: routingKey, dial: dial, pub: pub}, nil
+}
+
+// WriteMessage publishes the message, dialing a new publisher if the
+// previous one failed.
+func (t *AMQPTransport) WriteMessage(m *Message) (err error) {
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+	if t.pub == nil {
+		if t.pub, err = t.dial(); err != nil {
+			t.pub = nil
+			return
+		}
+	}
+	if err = t.pub.Publish(t.Exchange, t.RoutingKey, mBytes); err != nil {
+		closePublisher(t.pub)
+		t.pub = nil
+	}
+	return
+}
+
+// Close closes the publisher, which isn't dialed again.
+func (t *AMQPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	err := closePublisher(t.pub)
+	t.pub = nil
+	return err
+}
+
+// closePublisher closes pub, if it is an io.Closer.
+func closePublisher(pub AMQPPublisher) error {
+	if c, ok := pub.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
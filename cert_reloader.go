@@ -0,0 +1,140 @@
+package graylog
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a client certificate loaded from files, which can
+// be loaded again when they are rotated on disk, for instance by a
+// sidecar.  Its GetClientCertificate method is meant for tls.Config, so
+// new connections always present the latest certificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	onReload []func()
+}
+
+// NewCertReloader loads the PEM encoded certificate and key from the
+// given files.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key files again.  The previous
+// certificate is kept if they can't be loaded.  The callbacks registered
+// with OnReload are invoked after a successful reload.
+func (r *CertReloader) Reload() error {
+	modTime := r.filesModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	callbacks := r.onReload
+	r.mu.Unlock()
+
+	for _, cb := range callbacks {
+		cb()
+	}
+	return nil
+}
+
+// OnReload registers a callback invoked every time the certificate is
+// reloaded.  Transports use it to drop their long-lived connections, so
+// that the next one is established with the new certificate.
+func (r *CertReloader) OnReload(cb func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onReload = append(r.onReload, cb)
+}
+
+// Watch checks the modification time of the files every interval, and
+// reloads them when they change, until stop is called.  Errors are
+// ignored, the files are checked again at the next interval.
+func (r *CertReloader) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				r.mu.RLock()
+				changed := !r.filesModTime().Equal(r.modTime)
+				r.mu.RUnlock()
+				if changed {
+					r.Reload()
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// GetClientCertificate returns the current certificate, to be used as
+// tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// filesModTime returns the latest modification time of the files.
+func (r *CertReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// SetCertReloader makes the transport of the writer present the
+// certificate of r to the server, and connect again when it is reloaded.
+// HTTPS requests use it from their next connection, idle ones being
+// closed on reload.  TLS connections use it as GetClientCertificate.
+// TCP connections are dropped on reload, and dialed again for the next
+// message.  It must be called before the writer is
+// used, and does nothing for other transports.
+func (w *Writer) SetCertReloader(r *CertReloader) {
+	switch t := unwrapTransport(w.Transport).(type) {
+	case *httpTransport:
+		t.setCertReloader(r)
+	case *tcpTransport:
+		if t.tlsConfig != nil {
+			w.GetClientCertificate = r.GetClientCertificate
+		}
+		r.OnReload(t.reconnect)
+	}
+}
+
+func (t *httpTransport) setCertReloader(r *CertReloader) {
+	ht := t.transport()
+	if ht == nil {
+		return
+	}
+	if ht.TLSClientConfig == nil {
+		ht.TLSClientConfig = &tls.Config{}
+	}
+	ht.TLSClientConfig.GetClientCertificate = r.GetClientCertificate
+	r.OnReload(ht.CloseIdleConnections)
+}
@@ -0,0 +1,229 @@
+package graylog
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed client certificate with the given
+// serial number, and its key, as PEM files in dir.
+func writeTestCert(t *testing.T, dir string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "logrus-graylog-hook test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s", err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-certs")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	serials := make(chan int64, 2)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serials <- r.TLS.PeerCertificates[0].SerialNumber.Int64()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+
+	transport := ts.Client().Transport.(*http.Transport)
+	transport.TLSClientConfig.GetClientCertificate = reloader.GetClientCertificate
+	reloader.OnReload(transport.CloseIdleConnections)
+	client := &http.Client{Transport: transport}
+
+	post := func() int64 {
+		resp, err := client.Post(ts.URL, "application/json", nil)
+		if err != nil {
+			t.Fatalf("Post: %s", err)
+		}
+		resp.Body.Close()
+		return <-serials
+	}
+
+	if serial := post(); serial != 1 {
+		t.Errorf("expected the first certificate, got serial %d", serial)
+	}
+
+	writeTestCert(t, dir, 2)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if serial := post(); serial != 2 {
+		t.Errorf("expected a new connection with the rotated certificate, got serial %d", serial)
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-certs")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+	reloaded := make(chan struct{}, 1)
+	reloader.OnReload(func() { reloaded <- struct{}{} })
+
+	stop := reloader.Watch(10 * time.Millisecond)
+	defer stop()
+
+	writeTestCert(t, dir, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("rotated certificate should be reloaded")
+	}
+	cert, _ := reloader.GetClientCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("expected the rotated certificate, got %v", leaf)
+	}
+}
+
+func TestWriterCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-certs")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	serials := make(chan int64, 2)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serials <- r.TLS.PeerCertificates[0].SerialNumber.Int64()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+
+	w, err := NewWriter(ts.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	// trust the certificate of the test server
+	w.Transport.(*httpTransport).client = ts.Client()
+	w.SetCertReloader(reloader)
+
+	write := func() int64 {
+		if _, err := w.Write([]byte("message")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		return <-serials
+	}
+
+	if serial := write(); serial != 1 {
+		t.Errorf("expected the first certificate, got serial %d", serial)
+	}
+	writeTestCert(t, dir, 2)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if serial := write(); serial != 2 {
+		t.Errorf("expected a new connection with the rotated certificate, got serial %d", serial)
+	}
+}
+
+func TestWriterCertReloaderTCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-certs")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+
+	r := newTCPReader(t, "127.0.0.1:0")
+	defer r.Close()
+	w, err := NewWriter("tcp://" + r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.SetCertReloader(reloader)
+
+	tcp := w.Transport.(*tcpTransport)
+	dials := 0
+	dial := tcp.dial
+	tcp.dial = func(network, addr string) (net.Conn, error) {
+		dials++
+		return dial(network, addr)
+	}
+
+	w.Write([]byte("before"))
+	<-r.msgs
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	w.Write([]byte("after"))
+	<-r.msgs
+	if dials != 1 {
+		t.Errorf("the connection should be dialed again once after the reload, got %d dials", dials)
+	}
+}
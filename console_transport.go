@@ -0,0 +1,165 @@
+package graylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConsoleFormat is the output format of a console writer.
+type ConsoleFormat int
+
+const (
+	ConsolePretty ConsoleFormat = iota // level short_message key=value ...
+	ConsoleJSON                        // raw GELF JSON, one message per line
+)
+
+// severityNames are the syslog names of the GELF levels.
+var severityNames = [...]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+func severityName(level int32) string {
+	if level < 0 || int(level) >= len(severityNames) {
+		return strconv.Itoa(int(level))
+	}
+	return severityNames[level]
+}
+
+// ConsoleFormatter formats the messages printed by console writers in
+// the ConsolePretty format, as a line ending with a newline.
+type ConsoleFormatter interface {
+	Format(m *Message) []byte
+}
+
+// The ConsoleFormatterFunc type is an adapter to allow the use of
+// ordinary functions as ConsoleFormatter.
+type ConsoleFormatterFunc func(m *Message) []byte
+
+// Format calls f(m).
+func (f ConsoleFormatterFunc) Format(m *Message) []byte {
+	return f(m)
+}
+
+// PlainConsoleFormatter prints the syslog name of the level, the short
+// message, and the additional fields as sorted key=value pairs.
+var PlainConsoleFormatter ConsoleFormatter = ConsoleFormatterFunc(func(m *Message) []byte {
+	return formatConsole(m, severityName(m.Level))
+})
+
+// levelColors are the ANSI colors of the GELF levels.
+var levelColors = [...]string{
+	"\x1b[1;31m", // emerg, bold red
+	"\x1b[1;31m", // alert
+	"\x1b[31m",   // crit, red
+	"\x1b[31m",   // err
+	"\x1b[33m",   // warning, yellow
+	"\x1b[36m",   // notice, cyan
+	"\x1b[32m",   // info, green
+	"\x1b[90m",   // debug, gray
+}
+
+// NewColorConsoleFormatter returns a formatter like PlainConsoleFormatter
+// coloring the level name, red for errors, yellow for warnings and so on.
+// It returns PlainConsoleFormatter when the NO_COLOR environment
+// variable is set, see https://no-color.org.
+func NewColorConsoleFormatter() ConsoleFormatter {
+	if os.Getenv("NO_COLOR") != "" {
+		return PlainConsoleFormatter
+	}
+	return ConsoleFormatterFunc(func(m *Message) []byte {
+		name := severityName(m.Level)
+		if m.Level >= 0 && int(m.Level) < len(levelColors) {
+			name = levelColors[m.Level] + name + "\x1b[0m"
+		}
+		return formatConsole(m, name)
+	})
+}
+
+// consoleTransport prints messages to a local stream, for development
+// without a Graylog server.
+type consoleTransport struct {
+	mu        sync.Mutex
+	out       io.Writer
+	format    func() ConsoleFormat
+	formatter func() ConsoleFormatter
+}
+
+// NewConsoleWriter returns a GELF Writer printing messages to out in the
+// format selected by ConsoleFormat, rather than sending them to a server.
+// Its ConsoleFormatter colors the levels when out is a terminal.
+func NewConsoleWriter(out io.Writer) *Writer {
+	w := newWriter()
+	w.Transport = &consoleTransport{
+		out:       out,
+		format:    func() ConsoleFormat { return w.ConsoleFormat },
+		formatter: func() ConsoleFormatter { return w.ConsoleFormatter },
+	}
+	if isTerminal(out) {
+		w.ConsoleFormatter = NewColorConsoleFormatter()
+	}
+	if host, err := os.Hostname(); err == nil {
+		w.hostname = host
+	}
+	return w
+}
+
+// isTerminal reports whether out is a character device, like a terminal.
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// WriteMessage prints the specified message on a single line.
+func (t *consoleTransport) WriteMessage(m *Message) (err error) {
+	var line []byte
+	if t.format() == ConsoleJSON {
+		if line, err = json.Marshal(m); err != nil {
+			return
+		}
+		line = append(line, '\n')
+	} else if f := t.formatter(); f != nil {
+		line = f.Format(m)
+	} else {
+		line = PlainConsoleFormatter.Format(m)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.out.Write(line)
+	return
+}
+
+// formatConsole formats a message as a human-readable line, starting
+// with the given level name.
+func formatConsole(m *Message, level string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(level)
+	buf.WriteByte(' ')
+	buf.WriteString(m.Short)
+
+	keys := make([]string, 0, len(m.Extra))
+	for k := range m.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := syslogParamValue(m.Extra[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strings.TrimPrefix(k, AdditionalFieldPrefix))
+		buf.WriteByte('=')
+		buf.WriteString(v)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
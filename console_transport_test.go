@@ -0,0 +1,98 @@
+package graylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestConsoleWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewConsoleWriter(&out)
+	w.WriteMessage(&Message{
+		Version: "1.1",
+		Host:    "testing.local",
+		Short:   "user logged in",
+		Level:   SyslogInfoLevel,
+		Extra:   map[string]interface{}{"_user": "alice", "_took": 1.5, "_note": "first time"},
+	})
+
+	expected := "info user logged in note=\"first time\" took=1.5 user=alice\n"
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestConsoleWriterJSON(t *testing.T) {
+	var out bytes.Buffer
+	w := NewConsoleWriter(&out)
+	w.ConsoleFormat = ConsoleJSON
+	w.WriteMessage(&Message{
+		Version: "1.1",
+		Short:   "user logged in",
+		Level:   SyslogErrorLevel,
+		Extra:   map[string]interface{}{"_user": "alice"},
+	})
+
+	var m Message
+	if err := json.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatalf("output should be GELF JSON, got %q: %s", out.String(), err)
+	}
+	if m.Short != "user logged in" || m.Extra["_user"] != "alice" {
+		t.Errorf("unexpected message decoded from %q", out.String())
+	}
+}
+
+func TestConsoleSchemes(t *testing.T) {
+	for scheme, out := range map[string]*os.File{"stdout://": os.Stdout, "stderr://": os.Stderr} {
+		w, err := NewWriter(scheme)
+		if err != nil {
+			t.Fatalf("NewWriter(%s): %s", scheme, err)
+		}
+		ct, ok := w.Transport.(*consoleTransport)
+		if !ok || ct.out != out {
+			t.Errorf("%s should print to %s", scheme, out.Name())
+		}
+	}
+}
+
+func TestColorConsoleFormatter(t *testing.T) {
+	defer func(v string, ok bool) {
+		if ok {
+			os.Setenv("NO_COLOR", v)
+		} else {
+			os.Unsetenv("NO_COLOR")
+		}
+	}(os.LookupEnv("NO_COLOR"))
+
+	m := &Message{Version: "1.1", Short: "disk full", Level: 3}
+	os.Unsetenv("NO_COLOR")
+	if line := string(NewColorConsoleFormatter().Format(m)); line != "\x1b[31merr\x1b[0m disk full\n" {
+		t.Errorf("expected a red level, got %q", line)
+	}
+	m.Level = 4
+	if line := string(NewColorConsoleFormatter().Format(m)); line != "\x1b[33mwarning\x1b[0m disk full\n" {
+		t.Errorf("expected a yellow level, got %q", line)
+	}
+
+	os.Setenv("NO_COLOR", "1")
+	if line := string(NewColorConsoleFormatter().Format(m)); line != "warning disk full\n" {
+		t.Errorf("NO_COLOR should disable colors, got %q", line)
+	}
+}
+
+func TestCustomConsoleFormatter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewConsoleWriter(&out)
+	if w.ConsoleFormatter != nil {
+		t.Error("colors should be disabled when not printing to a terminal")
+	}
+	w.ConsoleFormatter = ConsoleFormatterFunc(func(m *Message) []byte {
+		return []byte(severityName(m.Level) + ": " + m.Short + "\n")
+	})
+	w.WriteMessage(&Message{Version: "1.1", Short: "custom", Level: 5})
+	if out.String() != "notice: custom\n" {
+		t.Errorf("expected the custom format, got %q", out.String())
+	}
+}
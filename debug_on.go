@@ -0,0 +1,8 @@
+//go:build gelfdebug
+// +build gelfdebug
+
+package graylog
+
+// debugAssertions enables internal consistency checks, build with
+// -tags gelfdebug to turn them on.
+const debugAssertions = true
@@ -0,0 +1,60 @@
+package graylog
+
+import "os"
+
+// DiscardTransport is a Transport on which all messages succeed without
+// being sent anywhere, like ioutil.Discard.
+type DiscardTransport struct{}
+
+// WriteMessage does nothing and returns nil.
+func (DiscardTransport) WriteMessage(m *Message) error {
+	return nil
+}
+
+// NewDiscardWriter returns a Writer which discards every message, to
+// disable Graylog output while keeping the Writer API.
+func NewDiscardWriter() *Writer {
+	w := newWriter()
+	w.Transport = DiscardTransport{}
+	if host, err := os.Hostname(); err == nil {
+		w.hostname = host
+	}
+	return w
+}
+
+// NewTransportWriter returns a Writer sending every message through t,
+// with the settings of NewWriter but no connection.  A TransportFunc
+// recording messages substitutes the network in tests, which can then
+// assert on the exact messages, after every Writer option was applied.
+func NewTransportWriter(t Transport) *Writer {
+	w := NewDiscardWriter()
+	w.Transport = t
+	return w
+}
+
+// encodedTransport encodes messages like the UDP transport and passes
+// them to the OnEncoded callback of the writer instead of sending them.
+type encodedTransport struct {
+	w *Writer
+}
+
+func (t encodedTransport) WriteMessage(m *Message) error {
+	zBytes, err := t.w.Encode(m)
+	if err != nil {
+		return err
+	}
+	if t.w.OnEncoded != nil {
+		t.w.OnEncoded(zBytes)
+	}
+	return nil
+}
+
+// NewEncodedWriter returns a Writer which sends nothing, and passes the
+// compressed GELF encoding of every message to onEncoded, for sinks like
+// an in-house message bus.
+func NewEncodedWriter(onEncoded func(compressed []byte)) *Writer {
+	w := NewDiscardWriter()
+	w.OnEncoded = onEncoded
+	w.Transport = encodedTransport{w}
+	return w
+}
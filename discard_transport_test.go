@@ -0,0 +1,56 @@
+package graylog
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"testing"
+)
+
+func TestDiscardWriter(t *testing.T) {
+	w := NewDiscardWriter()
+
+	msgData := "test message\nsecond line"
+	n, err := w.Write([]byte(msgData))
+	if err != nil {
+		t.Errorf("Write: %s", err)
+	}
+	if n != len(msgData) {
+		t.Errorf("Write should report all bytes written (exp: %d, got %d)", len(msgData), n)
+	}
+
+	m := &Message{Version: "1.1", Short: "message"}
+	if err := w.WriteMessage(m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+	}
+	if m.Extra != nil {
+		t.Errorf("WriteMessage should not modify the message, got extra %v", m.Extra)
+	}
+}
+
+func TestEncodedWriter(t *testing.T) {
+	var encoded [][]byte
+	w := NewEncodedWriter(func(compressed []byte) {
+		encoded = append(encoded, append([]byte(nil), compressed...))
+	})
+	w.CompressionType = CompressZlib
+
+	if _, err := w.Write([]byte("routed elsewhere")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if len(encoded) != 1 {
+		t.Fatalf("expected 1 encoded message, got %d", len(encoded))
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(encoded[0]))
+	if err != nil {
+		t.Fatalf("zlib.NewReader: %s", err)
+	}
+	var m Message
+	if err := json.NewDecoder(zr).Decode(&m); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if m.Short != "routed elsewhere" || m.Host != w.hostname {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
@@ -0,0 +1,253 @@
+package graylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DiskBuffer is a Transport spilling the messages its underlying
+// transport fails to send to a local file, one JSON record per line, and
+// replaying them once the transport recovers.  It suits edge deployments
+// with intermittent connectivity, which would otherwise drop messages.
+// The file outlives the process: records left by a previous run are
+// replayed too.
+type DiskBuffer struct {
+	next    Transport
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	replayMu sync.Mutex // serializes Replay, which doesn't hold mu while sending
+}
+
+// NewDiskBuffer returns a DiskBuffer in front of next, buffering to the
+// file at path up to maxSize bytes.  Messages which don't fit are dropped
+// and the error of next is returned for them.
+func NewDiskBuffer(next Transport, path string, maxSize int64) (*DiskBuffer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &DiskBuffer{next: next, path: path, maxSize: maxSize, file: file, size: fi.Size()}, nil
+}
+
+// WriteMessage sends the message with the underlying transport, and
+// appends it to the file when that fails.  While the file holds records,
+// messages are appended to it without being sent, so that they are sent
+// after the buffered ones; those which don't fit are still sent.
+func (b *DiskBuffer) WriteMessage(m *Message) error {
+	mBytes, merr := json.Marshal(m)
+	if merr == nil {
+		mBytes = append(mBytes, '\n')
+		b.mu.Lock()
+		if b.size > 0 && b.append(mBytes) == nil {
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+	}
+
+	err := b.next.WriteMessage(m)
+	if err == nil || merr != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.append(mBytes) != nil {
+		return err
+	}
+	return nil
+}
+
+// append writes the record at the end of the file, if it fits.
+func (b *DiskBuffer) append(record []byte) error {
+	if b.size+int64(len(record)) > b.maxSize {
+		return errBufferFull
+	}
+	n, err := b.file.Write(record)
+	b.size += int64(n)
+	return err
+}
+
+var errBufferFull = errors.New("gelf: disk buffer full")
+
+// Buffered returns the size of the records waiting in the file.
+func (b *DiskBuffer) Buffered() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Replay sends the buffered messages with the underlying transport, in
+// the order they were buffered, including those appended meanwhile.  It
+// stops at the first failure, keeping that message and the following
+// ones for the next replay.  Corrupt records, like one cut short by a
+// crash, are skipped.
+//
+// The file is not locked while the messages are sent: WriteMessage keeps
+// appending to it, and a single Replay runs at a time.
+func (b *DiskBuffer) Replay() error {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+
+	for {
+		b.mu.Lock()
+		size := b.size
+		b.mu.Unlock()
+		if size == 0 {
+			return nil
+		}
+
+		data, err := b.read(size)
+		if err != nil {
+			return err
+		}
+		sent, err := b.send(data)
+		if terr := b.remove(sent); terr != nil {
+			return terr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// read returns the first size bytes of the file.
+func (b *DiskBuffer) read(size int64) ([]byte, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	_, err = io.ReadFull(f, data)
+	return data, err
+}
+
+// send sends the records of data, returning the length of those sent.
+func (b *DiskBuffer) send(data []byte) (int64, error) {
+	var sent int64
+	for len(data) > 0 {
+		record := data
+		rest := []byte(nil)
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			record, rest = data[:i], data[i+1:]
+		}
+
+		var m Message
+		if len(record) > 0 && json.Unmarshal(record, &m) == nil {
+			if err := b.next.WriteMessage(&m); err != nil {
+				return sent, err
+			}
+		}
+		sent += int64(len(data) - len(rest))
+		data = rest
+	}
+	return sent, nil
+}
+
+// remove drops the first n bytes of the file, keeping the records
+// appended since it was read.  The remaining records are written to a
+// temporary file renamed over the buffer, so that a crash meanwhile
+// loses none of them.
+func (b *DiskBuffer) remove(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < n {
+		n = int64(len(data))
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data[n:])
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// the buffer is closed first, as Windows can't rename over open files
+	b.file.Close()
+	err = os.Rename(tmp.Name(), b.path)
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	file, oerr := os.OpenFile(b.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if oerr != nil {
+		return oerr
+	}
+	b.file = file
+	if err != nil {
+		return err
+	}
+	b.size = int64(len(data)) - n
+	return nil
+}
+
+// StartReplay calls Replay every interval, until stop is called.
+// Replay errors are ignored, the messages are replayed again at the next
+// interval.
+func (b *DiskBuffer) StartReplay(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				b.Replay()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Close closes the file, and the underlying transport when it has a
+// connection.  The buffered messages stay in the file.
+func (b *DiskBuffer) Close() error {
+	b.mu.Lock()
+	err := b.file.Close()
+	b.mu.Unlock()
+
+	if c, ok := b.next.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,255 @@
+package graylog
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyTransport records the messages it sends, and fails while down.
+type flakyTransport struct {
+	captureTransport
+	downMu sync.Mutex
+	down   bool
+}
+
+var errOutage = errors.New("network unreachable")
+
+func (t *flakyTransport) WriteMessage(m *Message) error {
+	t.downMu.Lock()
+	down := t.down
+	t.downMu.Unlock()
+	if down {
+		return errOutage
+	}
+	return t.captureTransport.WriteMessage(m)
+}
+
+func (t *flakyTransport) setDown(down bool) {
+	t.downMu.Lock()
+	t.down = down
+	t.downMu.Unlock()
+}
+
+func (t *flakyTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.msgs)
+}
+
+func newBufferDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "graylog-buffer")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	return filepath.Join(dir, "gelf.buf"), func() { os.RemoveAll(dir) }
+}
+
+func TestDiskBufferOutage(t *testing.T) {
+	path, cleanup := newBufferDir(t)
+	defer cleanup()
+
+	ft := &flakyTransport{down: true}
+	db, err := NewDiskBuffer(ft, path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewDiskBuffer: %s", err)
+	}
+	w, _ := newCaptureWriter()
+	w.Transport = db
+
+	for _, short := range []string{"first", "second", "third"} {
+		if _, err := w.Write([]byte(short)); err != nil {
+			t.Fatalf("Write during the outage should be buffered: %s", err)
+		}
+	}
+	if err := db.Replay(); err != errOutage {
+		t.Errorf("Replay during the outage: expected %v, got %v", errOutage, err)
+	}
+	if db.Buffered() == 0 {
+		t.Fatal("messages should be buffered")
+	}
+	db.Close()
+
+	// the process restarts, a crash left a corrupt record behind
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	f.WriteString(`{"version":"1.1","sho`)
+	f.Close()
+
+	ft.setDown(false)
+	db, err = NewDiskBuffer(ft, path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewDiskBuffer: %s", err)
+	}
+	defer db.Close()
+	stop := db.StartReplay(10 * time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for db.Buffered() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Buffered() != 0 {
+		t.Fatal("buffer should be drained after the recovery")
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if len(ft.msgs) != 3 {
+		t.Fatalf("expected the 3 buffered messages, got %d", len(ft.msgs))
+	}
+	for i, short := range []string{"first", "second", "third"} {
+		if ft.msgs[i].Short != short {
+			t.Errorf("message %d: expected %q, got %q", i, short, ft.msgs[i].Short)
+		}
+		if ft.msgs[i].Host != "testing.local" {
+			t.Errorf("message %d: expected the host to be kept, got %q", i, ft.msgs[i].Host)
+		}
+	}
+}
+
+func TestDiskBufferPartialReplay(t *testing.T) {
+	path, cleanup := newBufferDir(t)
+	defer cleanup()
+
+	ft := &flakyTransport{down: true}
+	db, err := NewDiskBuffer(ft, path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewDiskBuffer: %s", err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		db.WriteMessage(&Message{Version: "1.1", Short: "buffered"})
+	}
+
+	fails := 0
+	db.next = TransportFunc(func(m *Message) error {
+		if ft.count() == 1 && fails == 0 {
+			fails++
+			return errOutage
+		}
+		return ft.captureTransport.WriteMessage(m)
+	})
+	size := db.Buffered()
+	if err := db.Replay(); err != errOutage {
+		t.Fatalf("expected the replay to stop on the failure, got %v", err)
+	}
+	if ft.count() != 1 || db.Buffered() == 0 || db.Buffered() >= size {
+		t.Fatalf("expected the sent message to leave the buffer, sent %d, %d/%d bytes left", ft.count(), db.Buffered(), size)
+	}
+	if err := db.Replay(); err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	if ft.count() != 3 || db.Buffered() != 0 {
+		t.Errorf("expected every message sent once, sent %d, %d bytes left", ft.count(), db.Buffered())
+	}
+}
+
+func TestDiskBufferFull(t *testing.T) {
+	path, cleanup := newBufferDir(t)
+	defer cleanup()
+
+	db, err := NewDiskBuffer(&flakyTransport{down: true}, path, 200)
+	if err != nil {
+		t.Fatalf("NewDiskBuffer: %s", err)
+	}
+	defer db.Close()
+
+	if err := db.WriteMessage(&Message{Version: "1.1", Short: "fits"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if err := db.WriteMessage(&Message{Version: "1.1", Short: "overflows the buffer"}); err != errOutage {
+		t.Errorf("expected the transport error once the buffer is full, got %v", err)
+	}
+}
+
+func TestDiskBufferOrder(t *testing.T) {
+	path, cleanup := newBufferDir(t)
+	defer cleanup()
+
+	ft := &flakyTransport{down: true}
+	db, err := NewDiskBuffer(ft, path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewDiskBuffer: %s", err)
+	}
+	defer db.Close()
+	db.WriteMessage(&Message{Version: "1.1", Short: "first"})
+
+	// the transport recovers before the replay
+	ft.setDown(false)
+	if err := db.WriteMessage(&Message{Version: "1.1", Short: "second"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if ft.count() != 0 {
+		t.Fatal("messages should wait behind the buffered ones")
+	}
+	if err := db.Replay(); err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	if ft.count() != 2 || ft.msgs[0].Short != "first" || ft.msgs[1].Short != "second" {
+		t.Errorf("expected the messages in order, got %d", ft.count())
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("only the buffer should be left, got %d files", len(files))
+	}
+
+	if err := db.WriteMessage(&Message{Version: "1.1", Short: "third"}); err != nil || ft.count() != 3 {
+		t.Errorf("an empty buffer should send directly, got %v and %d sent", err, ft.count())
+	}
+}
+
+func TestDiskBufferWriteDuringReplay(t *testing.T) {
+	path, cleanup := newBufferDir(t)
+	defer cleanup()
+
+	ft := &flakyTransport{down: true}
+	db, err := NewDiskBuffer(ft, path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewDiskBuffer: %s", err)
+	}
+	defer db.Close()
+	db.WriteMessage(&Message{Version: "1.1", Short: "first"})
+	ft.setDown(false)
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	db.next = TransportFunc(func(m *Message) error {
+		if m.Short == "first" {
+			close(sending)
+			<-release
+		}
+		return ft.WriteMessage(m)
+	})
+	replayed := make(chan error)
+	go func() { replayed <- db.Replay() }()
+
+	<-sending
+	written := make(chan error)
+	go func() { written <- db.WriteMessage(&Message{Version: "1.1", Short: "second"}) }()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WriteMessage should not wait for the replay")
+	}
+	close(release)
+
+	if err := <-replayed; err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	if ft.count() != 2 || ft.msgs[1].Short != "second" || db.Buffered() != 0 {
+		t.Errorf("the message appended during the replay should be sent after, sent %d, %d bytes left", ft.count(), db.Buffered())
+	}
+}
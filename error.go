@@ -48,8 +48,11 @@ func extractStackTrace(err error) errors.StackTrace {
 	return tracer.StackTrace()
 }
 
-func extractFileAndLine(stacktrace errors.StackTrace) (string, int) {
+// extractCaller returns the file, line and function name of the top
+// frame of a stack trace.
+func extractCaller(stacktrace errors.StackTrace) (string, int, string) {
 	pc := uintptr(stacktrace[0])
 	fn := runtime.FuncForPC(pc)
-	return fn.FileLine(pc)
+	file, line := fn.FileLine(pc)
+	return file, line, fn.Name()
 }
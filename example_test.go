@@ -0,0 +1,30 @@
+package graylog
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tests intercept the messages of a hook, without network I/O, by giving
+// it a writer with a recording transport.
+func ExampleNewTransportWriter() {
+	var sent []*Message
+	w := NewTransportWriter(TransportFunc(func(m *Message) error {
+		sent = append(sent, m)
+		return nil
+	}))
+
+	hook := NewGraylogHook("127.0.0.1:12201", nil)
+	hook.SetWriter(w)
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Out = ioutil.Discard
+	log.WithField("order", 42).Warn("payment declined")
+
+	m := sent[0]
+	fmt.Println(m.Short, m.Level, m.Extra["_order"])
+	// Output: payment declined 5 42
+}
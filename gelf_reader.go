@@ -58,7 +58,8 @@ func (r *Reader) Read(p []byte) (int, error) {
 }
 
 func (r *Reader) ReadMessage() (*Message, error) {
-	cBuf := make([]byte, ChunkSize)
+	// room for the largest datagram, whatever the chunk size of the writer
+	cBuf := make([]byte, 65535)
 	var (
 		err        error
 		n, length  int
@@ -71,7 +72,8 @@ func (r *Reader) ReadMessage() (*Message, error) {
 	)
 
 	for got := 0; got < 128 && (total == 0 || got < int(total)); got++ {
-		if n, err = r.conn.Read(cBuf); err != nil {
+		// chunks may arrive in any order, the last and shorter one first
+		if n, err = r.conn.Read(cBuf[:cap(cBuf)]); err != nil {
 			return nil, fmt.Errorf("Read: %s", err)
 		}
 		cHead, cBuf = cBuf[:2], cBuf[:n]
@@ -7,14 +7,33 @@ package graylog
 import (
 	"bytes"
 	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Writer implements io.Writer and is used to send both discrete
@@ -24,10 +43,310 @@ type Writer struct {
 	mu               sync.Mutex
 	conn             net.Conn
 	hostname         string
+	network          string // dialed by UDP transports, "udp" unless set by the schema
 	Transport        Transport
-	Facility         string // defaults to current process name
+	Facility         string // sent literally when set, derived according to FacilitySource otherwise
 	CompressionLevel int    // one of the consts from compress/flate
 	CompressionType  CompressType
+	HostAsIP         bool           // send the primary outbound IP as host rather than the hostname, see DefaultHostAsIP
+	GELFVersion      string         // overrides the version of every message when set, to any non-blank string
+	MaxUDPPayload    int            // hybrid writers send larger payloads over TCP, defaults to MaxChunkSize
+	DurationFormat   DurationFormat // how time.Duration extra fields are sent
+	ForceFacility    *bool          // overrides whether facility is sent, see includeFacility
+
+	// AdaptiveCompression picks the compression level of every message from
+	// its serialized size: BestSpeed up to AdaptiveSmallSize bytes, where
+	// compression gains little, BestCompression from AdaptiveLargeSize
+	// bytes, where it gains the most, and CompressionLevel in between.
+	// The sizes default to ChunkSize and 8 * ChunkSize.
+	AdaptiveCompression bool
+	AdaptiveSmallSize   int
+	AdaptiveLargeSize   int
+
+	// MaxInputBytes makes Write split larger inputs, like a panic dump
+	// written through the standard log package, into several messages
+	// rather than failing to send them.  The parts share a _split_id and
+	// carry their _split_index and the _split_total.  Zero disables it.
+	MaxInputBytes int
+
+	// FacilitySource is how the facility of messages is derived when
+	// Facility is empty.
+	FacilitySource FacilitySource
+
+	// ShortFromLastLine makes Write use the last non-blank line of a
+	// multi-line input as the short message, rather than the first, for
+	// formatters printing a header above the salient line.  The full
+	// message is still the whole input.
+	ShortFromLastLine bool
+
+	// ConsoleFormat is the output format of console writers.
+	ConsoleFormat ConsoleFormat
+
+	// ConsoleFormatter formats the ConsolePretty lines of console writers,
+	// PlainConsoleFormatter when nil.
+	ConsoleFormatter ConsoleFormatter
+
+	// MaxUncompressedSize makes the UDP transport reject larger messages
+	// with ErrMessageTooLarge before compressing them, to save the CPU spent
+	// compressing messages which can't be sent anyway.  It should be set
+	// according to the compression ratio of the logs; zero disables it.
+	// Uncompressed messages are always checked against the GELF limit.
+	MaxUncompressedSize int
+
+	// HTTPCompression gzips the bodies sent to GELF HTTP inputs of at
+	// least HTTPCompressMinSize bytes, below which compression costs more
+	// latency than it saves.
+	HTTPCompression     bool
+	HTTPCompressMinSize int
+
+	// FullMessageGzipSize moves full messages of at least this many bytes,
+	// gzipped at CompressionLevel then base64 encoded, to the
+	// _full_message_gz field, leaving a preview of their first
+	// FullMessagePreview bytes as the full message.  This needs a Graylog
+	// pipeline decoding the field, but saves bandwidth for huge payloads
+	// over uncompressed HTTP.  Zero disables it.
+	FullMessageGzipSize int
+
+	// Environment is sent as the _environment field of every message when
+	// set.  It defaults to the GO_ENV or APP_ENV environment variable.
+	Environment string
+
+	// DetectKubernetes adds the _k8s_pod, _k8s_namespace and _k8s_node
+	// fields from the POD_NAME, POD_NAMESPACE and NODE_NAME environment
+	// variables, which the pod spec sets through the downward API, and the
+	// _container_id field from the cgroups of the process.  Fields which
+	// can't be determined are skipped.  They are detected once.
+	DetectKubernetes bool
+
+	// Module is sent as the _module field of every message when set.  With
+	// ModuleFromBuildInfo, an empty Module is replaced by the path of the
+	// main module of the binary.
+	Module              string
+	ModuleFromBuildInfo bool
+
+	// ShortMessageTemplate is a text/template producing the short message
+	// from the fields of the message, like "[{{.service}}] {{.short_message}}".
+	// Additional fields are available without their prefix, along with
+	// short_message, full_message, host, level and facility.  The original
+	// short message is kept if the template fails or produces nothing.
+	ShortMessageTemplate string
+
+	// CollapseWhitespace replaces runs of whitespace in the short and full
+	// messages with a single space.  Line breaks of the full message are
+	// kept, as a single newline.
+	CollapseWhitespace bool
+
+	// RedactPatterns replaces the matches of every pattern with "***" in
+	// the short and full messages and in the string additional fields,
+	// whatever their key, for values like card numbers or emails.
+	RedactPatterns []*regexp.Regexp
+
+	// IncludeFunc adds the function and package of the caller, taken from
+	// the same stack frame as the file and line, as the _func and _package
+	// fields.
+	IncludeFunc bool
+
+	// ChunkWriter, when set, transmits every chunk of the messages chunked
+	// over UDP in place of the connection, see ChunkWriter.
+	ChunkWriter ChunkWriter
+
+	// MaxChunkSize is the size of the UDP datagrams, chunk header included,
+	// ChunkSize by default.  Larger messages are chunked.  Raise it on
+	// networks with jumbo frames, lower it below the path MTU of tunnels.
+	MaxChunkSize int
+
+	// ParallelChunks writes up to that many chunks of a message at once,
+	// from a separate unconnected socket whose send buffer is sized for
+	// them, to fill high-bandwidth links.  Graylog reassembles chunks in
+	// any order.  Zero or one writes them in sequence on the connection.
+	ParallelChunks int
+
+	// ChunkDelay paces the chunks of a message written in sequence, so
+	// that bursts of large messages don't overflow the receive buffer of
+	// the server, which loses the whole message with any chunk.  The
+	// delay is paid between every chunk and blocks the caller, lowering
+	// the throughput of large messages: a few tens of microseconds
+	// usually suffice.  Zero, the default, sends them back to back.
+	ChunkDelay time.Duration
+
+	// NumericSuffix makes the additional fields whose key ends with it,
+	// like "_num", always numeric: numeric strings are converted, other
+	// values are dropped.  Elasticsearch maps a field as a keyword once it
+	// receives a string, which breaks aggregations on it.
+	NumericSuffix string
+
+	// ReservedFieldPolicy is what happens to additional fields colliding
+	// with a standard GELF field once prefixed, which only happens with an
+	// empty AdditionalFieldPrefix, or named _id, which GELF forbids.
+	ReservedFieldPolicy ReservedFieldPolicy
+
+	// FieldPrefix, like "db_", is inserted after AdditionalFieldPrefix in
+	// the keys of the additional fields of the messages written, so that
+	// the fields of subsystems sharing a stream don't collide.  Unlike
+	// the other settings it is honoured on writers derived with
+	// WithFields, which inherit it: the writer of a subsystem sends
+	// _db_query rather than _query.  Fields added by the writer itself,
+	// like _environment, aren't prefixed.
+	FieldPrefix string
+
+	// MessageFieldPolicy is what happens to an additional field named
+	// "message", which Graylog pipelines easily mistake for the short
+	// message.
+	MessageFieldPolicy MessageFieldPolicy
+
+	// DialTimeout bounds the resolution of the address and the connection
+	// of the transports, when the writer is created and when TCP
+	// connections are dialed again, as well as the TLS handshake of TLS
+	// connections.  It defaults to DefaultDialTimeout, zero means no
+	// timeout.
+	DialTimeout time.Duration
+
+	// KeepAlivePeriod is the interval of the keep-alive probes of TCP
+	// connections, which detect a silently dead peer, like a NAT which
+	// dropped the flow, before the next write.  It defaults to 30 seconds,
+	// zero disables the probes.
+	KeepAlivePeriod time.Duration
+
+	// NoMarshalFallback disables the degraded message sent in place of a
+	// message which can't be serialized, like one with a channel or NaN
+	// additional field.  The degraded message only has the standard
+	// fields and a _marshal_error describing the failure.  The error is
+	// returned either way.
+	NoMarshalFallback bool
+
+	// SendShutdownMarker makes Close and Shutdown send an info message
+	// with a true _shutdown field, once, before closing the connection.
+	// Processes whose last message lacks it didn't exit cleanly.
+	SendShutdownMarker bool
+
+	// TLSConfig is the TLS configuration of the tls:// transport, read
+	// before every handshake, which happens before the first message of a
+	// connection, and of HTTPS, read before the first message.  Its
+	// ServerName defaults to the host of the address.
+	TLSConfig *tls.Config
+
+	// ClientCertificate is the certificate presented to TLS and HTTPS
+	// inputs requiring client authentication, unless GetClientCertificate
+	// is set, which loads it for every handshake, like the method of a
+	// CertReloader.  They take precedence over the ones of TLSConfig, and
+	// are read at the same times.
+	ClientCertificate    *tls.Certificate
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	// RootCAs, ServerName and InsecureSkipVerify override the ones of
+	// TLSConfig when set, and are read at the same times: RootCAs is the
+	// pool of the internal CAs signing the certificate of the input,
+	// ServerName the name it is verified for, when it isn't the host of
+	// the address, and InsecureSkipVerify disables the verification, for
+	// lab environments only.
+	RootCAs            *x509.CertPool
+	ServerName         string
+	InsecureSkipVerify bool
+
+	// OnError is called with the errors detected in the background, like
+	// those surfaced by StartProbe, which no caller would see otherwise.
+	OnError func(error)
+
+	// DebugToStderr prints the errors of the transport to os.Stderr, at
+	// most one every DebugErrorInterval, counting the others, to diagnose
+	// messages lost by callers ignoring errors, like the async hook,
+	// without flooding the terminal while Graylog is down.
+	DebugToStderr bool
+
+	// OnEncoded is called with the bytes of every message sent over UDP,
+	// after compression and before chunking, to route them to another
+	// sink as well.  See NewEncodedWriter to only route them.  The slice
+	// must not be modified or kept after the call.
+	OnEncoded func(compressed []byte)
+
+	// Dialect selects the flavour of GELF the messages are serialized in,
+	// for collectors which predate GELF 1.0.
+	Dialect Dialect
+
+	// SortKeys serializes the additional fields sorted by key, for
+	// reproducible output in snapshot tests and captures.  It is off by
+	// default, sparing the sort on every message.
+	SortKeys bool
+
+	// IncludeStackHash adds a hash of the StackHashFrames innermost frames
+	// of the caller, 3 by default, as the _fingerprint field.  It groups
+	// recurring messages by call site, whatever ids their text contains.
+	IncludeStackHash bool
+	StackHashFrames  int
+
+	// IncludeGoroutineID adds the id of the goroutine calling WriteMessage
+	// as the _goroutine field.  This is a best-effort debugging aid: the id
+	// is parsed from runtime.Stack on every message, which is not cheap,
+	// and with the async hook it is the id of the background sender.
+	IncludeGoroutineID bool
+
+	// IncludeFieldCount adds the number of additional fields of every
+	// message, itself included, as the _field_count field, for dashboards
+	// spotting cardinality explosions.  It is counted last, after the
+	// fields of the hook and of WithFields are added and the limits
+	// applied, so it matches what is sent.
+	IncludeFieldCount bool
+
+	// Filter is called with every message right before it is sent, once
+	// all its fields are set, and the message is dropped if it returns
+	// false.  Dropped messages aren't an error, they are counted by
+	// Filtered.
+	Filter func(m *Message) bool
+
+	// MaxFieldKeyLength truncates longer additional field keys, prefix
+	// included, as Elasticsearch rejects the documents of overlong field
+	// names.  NewWriter sets it to DefaultMaxFieldKeyLength, zero disables
+	// it.
+	MaxFieldKeyLength int
+
+	// MaxShortLength truncates longer short messages, in bytes, as
+	// Graylog shows only the start of them in the search results.  When
+	// there is no full message the untruncated one becomes it.  Zero
+	// disables it.
+	MaxShortLength int
+
+	// TruncationMarkers makes the writer record the original byte length
+	// of what it truncated: _short_truncated_from when MaxShortLength cut
+	// the short message, and _field_truncated with _field_truncated_from,
+	// the length of the longest key, when MaxFieldKeyLength cut field
+	// keys.
+	TruncationMarkers bool
+
+	// MaxDistinctFields caps how many distinct additional field keys the
+	// writer sends over its lifetime, as Elasticsearch rejects documents
+	// once an index reaches its total fields limit, 1000 by default.  New
+	// keys beyond it are dropped and counted in _dropped_fields.  Zero
+	// disables it.
+	MaxDistinctFields int
+
+	hostIPOnce sync.Once
+	hostIP     string
+	moduleOnce sync.Once
+	mainModule string
+	tmplMu     sync.Mutex
+	tmplText   string
+	tmpl       *template.Template
+	tmplErr    error
+	pendingMu  sync.Mutex
+	pending    int
+	idle       chan struct{}
+	parent     *Writer
+	fields     map[string]interface{}
+
+	shutdownOnce sync.Once
+
+	k8sOnce   sync.Once
+	k8sFields map[string]interface{}
+
+	fieldsMu   sync.Mutex
+	seenFields map[string]struct{} // keys sent, for MaxDistinctFields
+
+	filteredMu sync.Mutex
+	filtered   uint64
+
+	debugMu         sync.Mutex
+	debugLast       time.Time // of the last error printed by DebugToStderr
+	debugSuppressed int
 }
 
 // CompressType is the compression type the writer should use when sending messages
@@ -40,23 +359,122 @@ const (
 	NoCompress
 )
 
+// DurationFormat is the representation used for time.Duration extra fields.
+type DurationFormat int
+
+const (
+	DurationNanoseconds DurationFormat = iota // integer nanoseconds, as encoding/json does
+	DurationSeconds                           // float seconds, like 1.5
+	DurationString                            // time.Duration.String, like "1.5s"
+)
+
+// Dialect is the flavour of GELF messages are serialized in.
+type Dialect int
+
+const (
+	DialectGELF1  Dialect = iota // GELF 1.0 and 1.1, with short_message and full_message
+	DialectGELF09                // legacy GELF 0.9, with a single message field and a required facility
+)
+
+// ReservedFieldPolicy is the handling of additional fields colliding with
+// the standard fields of a GELF message, which would produce duplicate
+// JSON keys.
+type ReservedFieldPolicy int
+
+const (
+	ReservedRename ReservedFieldPolicy = iota // prepend underscores to the key until it's free
+	ReservedDrop                              // drop the field
+	ReservedError                             // refuse the message
+)
+
+// MessageFieldPolicy is the handling of an additional field named
+// "message".  Prefixed it is the harmless _message, but it is ambiguous
+// all the same: Graylog stores the short message as its message field,
+// GELF 0.9 names the short message so, and with an empty
+// AdditionalFieldPrefix it is sent as a top-level message key.
+type MessageFieldPolicy int
+
+const (
+	MessageFieldRename  MessageFieldPolicy = iota // send it as _message, even without AdditionalFieldPrefix
+	MessageFieldPromote                           // make it the short message, the previous one becoming the full message if there is none
+)
+
+// reservedFields are the keys of the standard fields of a GELF message,
+// along with _id, which GELF forbids for additional fields.
+var reservedFields = map[string]bool{
+	"version": true, "host": true, "short_message": true, "full_message": true,
+	"timestamp": true, "level": true, "facility": true, "file": true,
+	"line": true, "_id": true,
+}
+
 // Message represents the contents of the GELF message.  It is gzipped
 // before sending.
 type Message struct {
 	Version  string                 `json:"version"`
 	Host     string                 `json:"host"`
 	Short    string                 `json:"short_message"`
-	Full     string                 `json:"full_message"`
+	Full     string                 `json:"full_message,omitempty"`
 	TimeUnix float64                `json:"timestamp"`
 	Level    int32                  `json:"level"`
-	Facility string                 `json:"facility"`
+	Facility string                 `json:"facility,omitempty"`
 	File     string                 `json:"file"`
 	Line     int                    `json:"line"`
 	Extra    map[string]interface{} `json:"-"`
+
+	dialect  Dialect
+	sortKeys bool
 }
 
 type innerMessage Message //against circular (Un)MarshalJSON
 
+// legacyMessage is the GELF 0.9 serialization of a Message.
+type legacyMessage struct {
+	Version  string  `json:"version"`
+	Host     string  `json:"host"`
+	Message  string  `json:"message"`
+	TimeUnix float64 `json:"timestamp"`
+	Level    int32   `json:"level"`
+	Facility string  `json:"facility"`
+	File     string  `json:"file"`
+	Line     int     `json:"line"`
+}
+
+// ErrNoTransport is returned when writing to a Writer without Transport,
+// like a zero Writer.
+var ErrNoTransport = errors.New("gelf: writer has no transport")
+
+// ErrClosed is returned when writing to a Writer after Close.
+var ErrClosed = errors.New("gelf: writer is closed")
+
+// ErrBlankVersion is returned when writing with a GELFVersion made only
+// of whitespace.
+var ErrBlankVersion = errors.New("gelf: blank version")
+
+// AdditionalFieldPrefix marks the additional fields of a GELF message.
+// Extra keys lacking it get it prepended when the message is marshalled,
+// as collectors ignore unprefixed fields.  It is read by the background
+// goroutines of writers and hooks without synchronization: set it
+// _before_ creating any writer or hook, and never change it afterwards.
+var AdditionalFieldPrefix = "_"
+
+// DefaultDialTimeout is the DialTimeout of new writers, which is what
+// bounds their creation.  Set it _before_ calling NewWriter.
+var DefaultDialTimeout = 5 * time.Second
+
+// DefaultHostAsIP is the HostAsIP of new writers.  When it is set,
+// NewWriter determines the outbound IP right away, so that no dial
+// happens while logging, and the hostname is sent if it can't.  Writers
+// setting HostAsIP themselves determine it on their first message.  Set
+// it _before_ calling NewWriter.
+var DefaultHostAsIP = false
+
+// GuessScheme makes NewWriter pick the transport of addresses without a
+// scheme from their port, rather than always using UDP: port 443 uses
+// HTTPS, port 80 uses HTTP, and so does 12201, the default GELF port,
+// when the address has a path.  Other addresses with a path are refused
+// as ambiguous.  Set it _before_ calling NewWriter.
+var GuessScheme = false
+
 // Transport defines a contract to send messages to a GELF endpoint.
 type Transport interface {
 	WriteMessage(m *Message) (err error)
@@ -65,35 +483,89 @@ type Transport interface {
 // NewWriter returns a new GELF Writer.  This writer can be used to send the
 // output of the standard Go log functions to a central GELF server by
 // passing it to log.SetOutput(). The addr parameter can include a schema,
-// which must be "http", "https", or "udp" (like http://graylog.example.com/gelf),
+// which must be "http", "https", "tcp" or "udp" (like http://graylog.example.com/gelf),
 // or can be a simple hostname (like 127.0.0.1:12201). If there is no schema
-// the writer will use UDP.
+// the writer will use UDP.  The "tls" schema sends to a GELF TCP input
+// over TLS, see TLSConfig, and the "unix" schema over a Unix stream socket,
+// like unix:///run/gelf.sock.  The "udp4" and "udp6" schemas force the
+// address family of UDP in dual-stack environments, and the "unixgram" schema sends the
+// UDP datagrams, compressed and chunked alike, over a Unix datagram
+// socket, for a local log shipper.  The "ndjson" schema sends newline delimited
+// JSON messages over TCP, for line based inputs.  The "syslog" schema sends RFC 5424 syslog lines
+// over UDP instead of GELF messages, and the "stdout" and "stderr" schemas
+// print messages locally, see NewConsoleWriter.  Kafka and AMQP, which
+// need a client of their own, are supported by NewKafkaTransport and
+// NewAMQPTransport rather than "kafka" and "amqp" schemas.  The "ws" and "wss" schemas
+// send messages as WebSocket text frames, wss with the TLS settings of
+// tls, in builds with -tags gelfwebsocket.
 func NewWriter(addr string) (*Writer, error) {
 	var err error
 	var t Transport
 	var segs = strings.Split(addr, "://")
-	w := &Writer{
-		Facility:         path.Base(os.Args[0]),
-		CompressionLevel: flate.BestSpeed,
+	if len(segs) == 1 && GuessScheme {
+		scheme, err := guessScheme(addr)
+		if err != nil {
+			return nil, err
+		}
+		if scheme == "http" || scheme == "https" {
+			addr = scheme + "://" + addr
+		}
+		segs = []string{scheme, segs[0]}
+	}
+	switch segs[0] {
+	case "stdout":
+		return NewConsoleWriter(os.Stdout), nil
+	case "stderr":
+		return NewConsoleWriter(os.Stderr), nil
+	case "kafka":
+		return nil, errors.New("gelf: kafka:// needs a Kafka client, see NewKafkaTransport")
+	case "amqp", "amqps":
+		return nil, errors.New("gelf: amqp:// needs an AMQP client, see NewAMQPTransport")
 	}
+	w := newWriter()
 
 	if segs[0] == "http" || segs[0] == "https" {
 		t = &httpTransport{
-			client: &http.Client{},
-			url:    addr,
+			client:           &http.Client{},
+			url:              addr,
+			compression:      func() bool { return w.HTTPCompression },
+			compressMinSize:  func() int { return w.HTTPCompressMinSize },
+			compressionLevel: w.compressionLevel,
+			tlsConfig:        w.tlsClientConfig,
+		}
+	} else if segs[0] == "tcp" {
+		if t, err = newTCPTransport(segs[1], w.dial); err != nil {
+			return nil, err
 		}
+	} else if segs[0] == "tls" {
+		if t, err = newTLSTransport(segs[1], w.dial, w.tlsClientConfig, w.dialTimeout); err != nil {
+			return nil, err
+		}
+	} else if segs[0] == "unix" {
+		if t, err = newUnixTransport(segs[1], w.dial); err != nil {
+			return nil, err
+		}
+	} else if segs[0] == "ndjson" {
+		if t, err = newNDJSONTransport(segs[1], w.dial); err != nil {
+			return nil, err
+		}
+	} else if segs[0] == "ws" || segs[0] == "wss" {
+		if t, err = newWSTransport(addr, w.dial, w.tlsClientConfig, w.dialTimeout); err != nil {
+			return nil, err
+		}
+	} else if segs[0] == "syslog" {
+		syslog := syslogTransport{}
+		if syslog.conn, err = w.dial("udp", segs[1]); err != nil {
+			return nil, err
+		}
+		t = &syslog
 	} else {
-		addr = segs[len(segs)-1]
-		udp := udpTransport{
-			compressionType:  func() CompressType { return w.CompressionType },
-			compressionLevel: func() int { return w.CompressionLevel },
+		if segs[0] == "udp4" || segs[0] == "udp6" || segs[0] == "unixgram" {
+			w.network = segs[0]
 		}
-
-		if udp.conn, err = net.Dial("udp", addr); err != nil {
+		if t, err = w.newUDPTransport(segs[len(segs)-1]); err != nil {
 			return nil, err
 		}
-
-		t = &udp
 	}
 
 	w.Transport = t
@@ -101,22 +573,840 @@ func NewWriter(addr string) (*Writer, error) {
 	if w.hostname, err = os.Hostname(); err != nil {
 		return nil, err
 	}
+	if w.HostAsIP {
+		w.outboundHost()
+	}
 
 	return w, nil
 }
 
+// dialTimeout returns DialTimeout, for the transports reading it when they
+// connect.
+func (w *Writer) dialTimeout() time.Duration {
+	return w.DialTimeout
+}
+
+// dial connects the transports, with DialTimeout, enabling keep-alive
+// probes on TCP connections according to KeepAlivePeriod.
+func (w *Writer) dial(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, addr, w.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if w.KeepAlivePeriod > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(w.KeepAlivePeriod)
+		} else {
+			tc.SetKeepAlive(false)
+		}
+	}
+	return conn, nil
+}
+
+// tlsClientConfig returns TLSConfig with the other TLS settings applied,
+// or nil when none is configured.
+func (w *Writer) tlsClientConfig() *tls.Config {
+	if w.TLSConfig == nil && w.ClientCertificate == nil && w.GetClientCertificate == nil &&
+		w.RootCAs == nil && w.ServerName == "" && !w.InsecureSkipVerify {
+		return nil
+	}
+	config := &tls.Config{}
+	if w.TLSConfig != nil {
+		config = w.TLSConfig.Clone()
+	}
+	if w.GetClientCertificate != nil {
+		config.GetClientCertificate = w.GetClientCertificate
+	} else if w.ClientCertificate != nil {
+		config.Certificates = []tls.Certificate{*w.ClientCertificate}
+		config.GetClientCertificate = nil
+	}
+	if w.RootCAs != nil {
+		config.RootCAs = w.RootCAs
+	}
+	if w.ServerName != "" {
+		config.ServerName = w.ServerName
+	}
+	if w.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+// guessScheme returns the scheme of a scheme-less address, see
+// GuessScheme.
+func guessScheme(addr string) (string, error) {
+	hostport, urlPath := addr, ""
+	if i := strings.Index(addr, "/"); i >= 0 {
+		hostport, urlPath = addr[:i], addr[i:]
+	}
+	_, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", fmt.Errorf("gelf: ambiguous address %q, prefix it with a scheme like udp:// or http://", addr)
+	}
+
+	switch {
+	case port == "443":
+		return "https", nil
+	case port == "80":
+		return "http", nil
+	case port == "12201" && urlPath != "":
+		return "http", nil
+	case urlPath != "":
+		return "", fmt.Errorf("gelf: ambiguous address %q, prefix it with a scheme like http:// or https://", addr)
+	}
+	return "udp", nil
+}
+
+// NewHybridWriter returns a new GELF Writer sending messages to addr
+// over UDP, unless their compressed size exceeds MaxUDPPayload, in which
+// case they are sent uncompressed to a GELF TCP input on the same address.
+func NewHybridWriter(addr string) (*Writer, error) {
+	var err error
+	w := newWriter()
+
+	h := &hybridTransport{}
+	if h.udp, err = w.newUDPTransport(addr); err != nil {
+		return nil, err
+	}
+	h.maxUDPPayload = func() int {
+		if w.MaxUDPPayload > 0 {
+			return w.MaxUDPPayload
+		}
+		return h.udp.size()
+	}
+	if h.tcp, err = newTCPTransport(addr, w.dial); err != nil {
+		h.udp.conn.Close()
+		return nil, err
+	}
+
+	w.Transport = h
+
+	if w.hostname, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func newWriter() *Writer {
+	return &Writer{
+		CompressionLevel: flate.BestSpeed,
+		Environment:      defaultEnvironment(),
+		DialTimeout:      DefaultDialTimeout,
+		KeepAlivePeriod:  30 * time.Second,
+		HostAsIP:         DefaultHostAsIP,
+
+		MaxFieldKeyLength: DefaultMaxFieldKeyLength,
+	}
+}
+
+// DefaultMaxFieldKeyLength is the MaxFieldKeyLength of the writers
+// created by NewWriter.
+const DefaultMaxFieldKeyLength = 256
+
+// readBuildInfo is debug.ReadBuildInfo, replaced in tests.
+var readBuildInfo = debug.ReadBuildInfo
+
+// module returns the module sent with every message, reading the build
+// information embedded in the binary once if needed.
+func (w *Writer) module() string {
+	if w.Module != "" || !w.ModuleFromBuildInfo {
+		return w.Module
+	}
+	return w.buildModule()
+}
+
+// buildModule returns the path of the main module from the build
+// information embedded in the binary, read once.  It is empty without
+// build information.
+func (w *Writer) buildModule() string {
+	w.moduleOnce.Do(func() {
+		if info, ok := readBuildInfo(); ok {
+			w.mainModule = info.Main.Path
+		}
+	})
+	return w.mainModule
+}
+
+// FacilitySource is a way to derive the facility of messages.
+type FacilitySource int
+
+const (
+	// FacilityFromModule uses the last element of the main module path,
+	// without its major version suffix, like "billing" for
+	// "github.com/example/billing/v2".  It falls back to FacilityFromArgs
+	// for binaries built without module information.
+	FacilityFromModule FacilitySource = iota
+	// FacilityFromArgs uses the name of the executable, which is
+	// unhelpful for "go run" builds and test binaries.
+	FacilityFromArgs
+)
+
+// defaultFacility returns the facility derived according to
+// FacilitySource.
+func (w *Writer) defaultFacility() string {
+	if w.FacilitySource == FacilityFromModule {
+		if mod := w.buildModule(); mod != "" && mod != "command-line-arguments" {
+			base := path.Base(mod)
+			if isMajorVersion(base) && path.Dir(mod) != "." {
+				base = path.Base(path.Dir(mod))
+			}
+			return base
+		}
+	}
+	return path.Base(os.Args[0])
+}
+
+// isMajorVersion reports whether s is a module major version suffix,
+// like "v2".
+func isMajorVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultEnvironment returns the deployment environment from the
+// conventional GO_ENV or APP_ENV variables.
+func defaultEnvironment() string {
+	if env := os.Getenv("GO_ENV"); env != "" {
+		return env
+	}
+	return os.Getenv("APP_ENV")
+}
+
+func (w *Writer) newUDPTransport(addr string) (*udpTransport, error) {
+	var err error
+	udp := udpTransport{
+		compressionType:     func() CompressType { return w.CompressionType },
+		compressionLevel:    w.compressionLevel,
+		maxUncompressedSize: func() int { return w.MaxUncompressedSize },
+		chunkWriter:         func() ChunkWriter { return w.ChunkWriter },
+		onEncoded:           func() func([]byte) { return w.OnEncoded },
+		chunkSize:           func() int { return w.MaxChunkSize },
+		parallelChunks:      func() int { return w.ParallelChunks },
+		chunkDelay:          func() time.Duration { return w.ChunkDelay },
+	}
+
+	network := w.network
+	if network == "" {
+		network = "udp"
+	}
+	if ShareUDPSockets {
+		shared, err := dialShared(network, addr, w.dial)
+		if err != nil {
+			return nil, err
+		}
+		udp.conn, udp.sendMu = shared, &shared.socket.mu
+	} else if udp.conn, err = w.dial(network, addr); err != nil {
+		return nil, err
+	}
+
+	return &udp, nil
+}
+
 // WriteMessage sends the specified message to the GELF server
 // specified in the call to New().  It assumes all the fields are
 // filled out appropriately.  In general, clients will want to use
 // Write, rather than WriteMessage.
 func (w *Writer) WriteMessage(m *Message) (err error) {
+	if w.parent != nil {
+		for k, v := range w.fields {
+			if _, ok := m.Extra[k]; !ok {
+				m.setExtra(k, v)
+			}
+		}
+		w.prefixFields(m)
+		return w.parent.WriteMessage(m)
+	}
+	if w.Transport == nil {
+		return ErrNoTransport
+	}
+	w.begin()
+	defer w.end()
+
+	w.prefixFields(m)
+
+	if w.HostAsIP {
+		if ip := w.outboundHost(); ip != "" {
+			m.Host = ip
+		}
+	}
+	m.sortKeys = w.SortKeys
+	if m.dialect = w.Dialect; m.dialect == DialectGELF09 {
+		m.Version = "0.9"
+	}
+	if w.GELFVersion != "" {
+		if strings.TrimSpace(w.GELFVersion) == "" {
+			return ErrBlankVersion
+		}
+		m.Version = w.GELFVersion
+	}
+	if w.Environment != "" {
+		if _, ok := m.Extra[AdditionalFieldPrefix+"environment"]; !ok {
+			m.setExtra(AdditionalFieldPrefix+"environment", w.Environment)
+		}
+	}
+	if w.DetectKubernetes {
+		for k, v := range w.kubernetesFields() {
+			if _, ok := m.Extra[k]; !ok {
+				m.setExtra(k, v)
+			}
+		}
+	}
+	if module := w.module(); module != "" {
+		if _, ok := m.Extra[AdditionalFieldPrefix+"module"]; !ok {
+			m.setExtra(AdditionalFieldPrefix+"module", module)
+		}
+	}
+	if w.ShortMessageTemplate != "" {
+		if short := w.templateShort(m); short != "" {
+			m.Short = short
+		}
+	}
+	if w.CollapseWhitespace {
+		m.Short = collapseWhitespace(m.Short, false)
+		m.Full = collapseWhitespace(m.Full, true)
+	}
+	if len(w.RedactPatterns) > 0 {
+		m.Short = w.redact(m.Short)
+		m.Full = w.redact(m.Full)
+		for k, v := range m.Extra {
+			if s, ok := v.(string); ok {
+				m.Extra[k] = w.redact(s)
+			}
+		}
+	}
+	if w.IncludeGoroutineID {
+		m.setExtra(AdditionalFieldPrefix+"goroutine", goroutineID())
+	}
+	if v, ok := m.Extra["message"]; ok {
+		w.checkMessageField(m, v)
+	}
+	if err := w.checkReserved(m); err != nil {
+		return err
+	}
+	if w.DurationFormat != DurationNanoseconds {
+		for k, v := range m.Extra {
+			if d, ok := v.(time.Duration); ok {
+				m.Extra[k] = w.formatDuration(d)
+			}
+		}
+	}
+	if w.NumericSuffix != "" {
+		for k, v := range m.Extra {
+			if !strings.HasSuffix(k, w.NumericSuffix) {
+				continue
+			}
+			if n, ok := toNumber(v); ok {
+				m.Extra[k] = n
+			} else {
+				delete(m.Extra, k)
+			}
+		}
+	}
+	if w.MaxShortLength > 0 && len(m.Short) > w.MaxShortLength {
+		w.truncateShort(m)
+	}
+	w.limitFields(m)
+	if w.FullMessageGzipSize > 0 && len(m.Full) >= w.FullMessageGzipSize {
+		if err := w.gzipFull(m); err != nil {
+			return err
+		}
+	}
+	if !w.includeFacility(m.Version) {
+		m.Facility = ""
+	} else if m.Facility == "" {
+		// an empty facility displays oddly, derive one
+		if m.Facility = w.facility(); m.Facility == "" {
+			m.Facility = w.defaultFacility()
+		}
+	}
+	if w.IncludeFieldCount {
+		delete(m.Extra, AdditionalFieldPrefix+"field_count")
+		m.setExtra(AdditionalFieldPrefix+"field_count", len(m.Extra)+1)
+	}
+	if w.Filter != nil && !w.Filter(m) {
+		w.filteredMu.Lock()
+		w.filtered++
+		w.filteredMu.Unlock()
+		return nil
+	}
+
+	err = w.Transport.WriteMessage(m)
+	if isMarshalError(err) && !w.NoMarshalFallback {
+		// the caller of a logging path rarely checks errors, send what
+		// can be sent rather than lose the log silently
+		w.Transport.WriteMessage(degradedMessage(m, err))
+	}
+	if err != nil && w.DebugToStderr {
+		w.debugError(m, err)
+	}
+	return err
+}
+
+// DebugErrorInterval is the minimum interval between the errors printed
+// by DebugToStderr.
+var DebugErrorInterval = time.Second
+
+// stderr is where DebugToStderr prints, replaced in tests.
+var stderr io.Writer = os.Stderr
+
+// debugError prints the failure to send m to stderr, unless another one
+// was printed less than DebugErrorInterval ago.
+func (w *Writer) debugError(m *Message, err error) {
+	w.debugMu.Lock()
+	defer w.debugMu.Unlock()
+
+	now := time.Now()
+	if !w.debugLast.IsZero() && now.Sub(w.debugLast) < DebugErrorInterval {
+		w.debugSuppressed++
+		return
+	}
+	suppressed := ""
+	if w.debugSuppressed > 0 {
+		suppressed = fmt.Sprintf(" (%d more errors suppressed)", w.debugSuppressed)
+	}
+	fmt.Fprintf(stderr, "gelf: sending %.64q failed: %s%s\n", m.Short, err, suppressed)
+	w.debugLast, w.debugSuppressed = now, 0
+}
+
+// truncateShort cuts the short message to MaxShortLength, at a rune
+// boundary.  A single-line message is kept whole as the full message.
+func (w *Writer) truncateShort(m *Message) {
+	from := len(m.Short)
+	end := w.MaxShortLength
+	for end > 0 && !utf8.RuneStart(m.Short[end]) {
+		end--
+	}
+	if m.Full == "" {
+		m.Full = m.Short
+	}
+	m.Short = m.Short[:end]
+	if w.TruncationMarkers {
+		m.setExtra(AdditionalFieldPrefix+"short_truncated_from", from)
+	}
+}
+
+// FullMessagePreview is the length of the preview left as the full
+// message by FullMessageGzipSize.
+const FullMessagePreview = 256
+
+// gzipFull moves the full message to the _full_message_gz field, see
+// FullMessageGzipSize.
+func (w *Writer) gzipFull(m *Message) error {
+	zBytes, err := compress([]byte(m.Full), CompressGzip, w.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	m.setExtra(AdditionalFieldPrefix+"full_message_gz", base64.StdEncoding.EncodeToString(zBytes))
 
-	return w.Transport.WriteMessage(m)
+	end := FullMessagePreview
+	if end < len(m.Full) {
+		for end > 0 && !utf8.RuneStart(m.Full[end]) {
+			end--
+		}
+		m.Full = m.Full[:end]
+	}
+	return nil
+}
+
+// limitFields enforces MaxFieldKeyLength and MaxDistinctFields on the
+// additional fields, reporting the keys truncated or dropped to OnError.
+func (w *Writer) limitFields(m *Message) {
+	truncatedFrom := 0
+	if w.MaxFieldKeyLength > 0 {
+		for k, v := range m.Extra {
+			key := prefixKey(k)
+			if len(key) <= w.MaxFieldKeyLength {
+				continue
+			}
+			if len(key) > truncatedFrom {
+				truncatedFrom = len(key)
+			}
+			end := w.MaxFieldKeyLength
+			for end > 0 && !utf8.RuneStart(key[end]) {
+				end--
+			}
+			delete(m.Extra, k)
+			if _, ok := m.Extra[key[:end]]; !ok {
+				m.Extra[key[:end]] = v
+			}
+			w.reportError(fmt.Errorf("gelf: field key %.32q... truncated to %d bytes", key, end))
+		}
+	}
+
+	// the markers are added last, so MaxDistinctFields doesn't drop them
+	if truncatedFrom > 0 && w.TruncationMarkers {
+		defer func() {
+			m.setExtra(AdditionalFieldPrefix+"field_truncated", true)
+			m.setExtra(AdditionalFieldPrefix+"field_truncated_from", truncatedFrom)
+		}()
+	}
+
+	if w.MaxDistinctFields <= 0 || len(m.Extra) == 0 {
+		return
+	}
+	w.fieldsMu.Lock()
+	if w.seenFields == nil {
+		w.seenFields = make(map[string]struct{})
+	}
+	dropped := 0
+	for k := range m.Extra {
+		key := prefixKey(k)
+		if _, ok := w.seenFields[key]; ok {
+			continue
+		}
+		if len(w.seenFields) >= w.MaxDistinctFields {
+			delete(m.Extra, k)
+			dropped++
+			continue
+		}
+		w.seenFields[key] = struct{}{}
+	}
+	w.fieldsMu.Unlock()
+
+	if dropped > 0 {
+		m.Extra[AdditionalFieldPrefix+"dropped_fields"] = dropped
+		w.reportError(fmt.Errorf("gelf: %d fields dropped, MaxDistinctFields (%d) reached", dropped, w.MaxDistinctFields))
+	}
+}
+
+// reportError passes err to OnError, if set.
+func (w *Writer) reportError(err error) {
+	if w.OnError != nil {
+		w.OnError(err)
+	}
+}
+
+// isMarshalError reports whether err comes from the serialization of a
+// message, rather than from sending it.
+func isMarshalError(err error) bool {
+	switch err.(type) {
+	case *json.UnsupportedTypeError, *json.UnsupportedValueError, *json.MarshalerError:
+		return true
+	}
+	return false
+}
+
+// degradedMessage returns the standard fields of a message which can't
+// be serialized, along with the _marshal_error describing why.
+func degradedMessage(m *Message, err error) *Message {
+	degraded := *m
+	degraded.Extra = map[string]interface{}{AdditionalFieldPrefix + "marshal_error": err.Error()}
+	return &degraded
+}
+
+// Encode returns the bytes the UDP transport would send for the message,
+// after serialization and compression but before chunking.  Nothing is
+// sent.  Derived writers encode with the settings of their root writer,
+// as they send through it.
+func (w *Writer) Encode(m *Message) ([]byte, error) {
+	r := w.root()
+	m.dialect, m.sortKeys = r.Dialect, r.SortKeys
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return compress(mBytes, r.CompressionType, r.compressionLevel(len(mBytes)))
+}
+
+// WouldChunk reports whether the UDP transport would chunk the message,
+// and in how many chunks, from its Encode bytes and the chunk size of the
+// transport, GELF UDP inputs with chunking disabled dropping the chunked
+// messages.  Nothing is sent.  Writers not sending over UDP are checked
+// against MaxChunkSize, or ChunkSize.
+func (w *Writer) WouldChunk(m *Message) (bool, int, error) {
+	r := w.root()
+	b, err := r.Encode(m)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var udp *udpTransport
+	switch t := unwrapTransport(r.Transport).(type) {
+	case *udpTransport:
+		udp = t
+	case *hybridTransport:
+		udp = t.udp
+	default:
+		udp = &udpTransport{chunkSize: func() int { return r.MaxChunkSize }}
+	}
+	n := numChunksOf(b, udp.size())
+	return n > 1, n, nil
+}
+
+// compressionLevel returns the compression level for a serialized
+// message of the given size.
+func (w *Writer) compressionLevel(size int) int {
+	if !w.AdaptiveCompression {
+		return w.CompressionLevel
+	}
+
+	small, large := w.AdaptiveSmallSize, w.AdaptiveLargeSize
+	if small <= 0 {
+		small = ChunkSize
+	}
+	if large <= 0 {
+		large = 8 * ChunkSize
+	}
+	switch {
+	case size <= small:
+		return flate.BestSpeed
+	case size >= large:
+		return flate.BestCompression
+	}
+	return w.CompressionLevel
+}
+
+// includeFacility reports whether the facility field should be sent for
+// the given version field.  Facility is deprecated in GELF 1.1 and some
+// collectors reject it, so it is only sent when the version names an
+// older GELF specification, or is unset, unless ForceFacility says
+// otherwise.  A custom version such as "1.1-routing-eu" is judged by the
+// specification version it starts with; one naming none, such as
+// "routing-eu", is taken as the current specification.  The GELF 0.9
+// dialect always sends it.
+func (w *Writer) includeFacility(version string) bool {
+	if w.Dialect == DialectGELF09 {
+		return true
+	}
+	if w.ForceFacility != nil {
+		return *w.ForceFacility
+	}
+	if version == "" {
+		return true
+	}
+	spec := specVersion(version)
+	return spec == "1.0" || strings.HasPrefix(spec, "0.")
+}
+
+// specVersion returns the GELF specification version that version starts
+// with, "1.1" for "1.1-routing-eu", or "" if it starts with none.
+func specVersion(version string) string {
+	i, dot := 0, false
+	for ; i < len(version); i++ {
+		c := version[i]
+		if c == '.' && !dot && i > 0 {
+			dot = true
+			continue
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+	}
+	if !dot || version[i-1] == '.' {
+		return ""
+	}
+	return version[:i]
+}
+
+func (w *Writer) formatDuration(d time.Duration) interface{} {
+	switch w.DurationFormat {
+	case DurationSeconds:
+		return d.Seconds()
+	case DurationString:
+		return d.String()
+	}
+	return int64(d)
+}
+
+// templateShort renders ShortMessageTemplate for the message, or returns
+// an empty string if it fails.  The parsed template is cached until
+// ShortMessageTemplate changes.
+func (w *Writer) templateShort(m *Message) string {
+	w.tmplMu.Lock()
+	if w.tmplText != w.ShortMessageTemplate {
+		w.tmplText = w.ShortMessageTemplate
+		w.tmpl, w.tmplErr = template.New("short_message").Option("missingkey=error").Parse(w.tmplText)
+	}
+	tmpl, err := w.tmpl, w.tmplErr
+	w.tmplMu.Unlock()
+	if err != nil {
+		return ""
+	}
+
+	data := make(map[string]interface{}, len(m.Extra)+5)
+	for k, v := range m.Extra {
+		data[strings.TrimPrefix(k, AdditionalFieldPrefix)] = v
+	}
+	data["short_message"] = m.Short
+	data["full_message"] = m.Full
+	data["host"] = m.Host
+	data["level"] = m.Level
+	data["facility"] = m.Facility
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// collapseWhitespace replaces every run of whitespace in s with a single
+// space, or with a single newline if keepNewlines is set and the run
+// contains one.
+func collapseWhitespace(s string, keepNewlines bool) string {
+	var buf bytes.Buffer
+	buf.Grow(len(s))
+	inRun, newline := false, false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			inRun = true
+			newline = newline || (keepNewlines && r == '\n')
+			continue
+		}
+		if inRun && buf.Len() > 0 {
+			if newline {
+				buf.WriteByte('\n')
+			} else {
+				buf.WriteByte(' ')
+			}
+		}
+		inRun, newline = false, false
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// checkMessageField applies MessageFieldPolicy to the "message"
+// additional field of the message, of value v.
+func (w *Writer) checkMessageField(m *Message, v interface{}) {
+	switch w.MessageFieldPolicy {
+	case MessageFieldPromote:
+		delete(m.Extra, "message")
+		if m.Full == "" {
+			m.Full = m.Short
+		}
+		m.Short = fmt.Sprint(v)
+	default:
+		if AdditionalFieldPrefix != "" {
+			return // prefixed when sent
+		}
+		renamed := "_message"
+		for _, taken := m.Extra[renamed]; taken; _, taken = m.Extra[renamed] {
+			renamed = "_" + renamed
+		}
+		delete(m.Extra, "message")
+		m.Extra[renamed] = v
+	}
+}
+
+// checkReserved applies ReservedFieldPolicy to the additional fields of
+// the message colliding with reserved fields.
+func (w *Writer) checkReserved(m *Message) error {
+	for k, v := range m.Extra {
+		name := k
+		if !strings.HasPrefix(name, AdditionalFieldPrefix) {
+			name = AdditionalFieldPrefix + name
+		}
+		if !reservedFields[name] {
+			continue
+		}
+
+		switch w.ReservedFieldPolicy {
+		case ReservedError:
+			return fmt.Errorf("gelf: additional field %q collides with a reserved field", k)
+		case ReservedDrop:
+			delete(m.Extra, k)
+		default:
+			renamed := "_" + name
+			for _, taken := m.Extra[renamed]; taken || reservedFields[renamed]; _, taken = m.Extra[renamed] {
+				renamed = "_" + renamed
+			}
+			delete(m.Extra, k)
+			m.Extra[renamed] = v
+		}
+	}
+	return nil
+}
+
+// toNumber returns v as a number, parsing strings, and whether it is one.
+func toNumber(v interface{}) (interface{}, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return n, true
+	case string:
+		s := strings.TrimSpace(n)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f, true
+		}
+		return nil, false
+	}
+
+	// numeric kinds, including named types like time.Duration
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v, true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		return v, !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return nil, false
+}
+
+// redact replaces the matches of RedactPatterns in s.
+func (w *Writer) redact(s string) string {
+	for _, re := range w.RedactPatterns {
+		s = re.ReplaceAllLiteralString(s, "***")
+	}
+	return s
+}
+
+// goroutineID parses the id of the current goroutine from the
+// "goroutine N [running]:" header written by runtime.Stack.  It returns 0
+// if the header can't be parsed.
+func goroutineID() int64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// outboundIP returns the local address used to reach the outside world.
+// Dialing UDP sends no packets, it only makes the kernel pick a route.
+var outboundIP = func() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// outboundHost returns the cached outbound IP, determining it on the
+// first call, or an empty string if it could not be determined, in which
+// case the hostname is kept.
+func (w *Writer) outboundHost() string {
+	w.hostIPOnce.Do(func() {
+		if ip, err := outboundIP(); err == nil {
+			w.hostIP = ip.String()
+		}
+	})
+	return w.hostIP
 }
 
 /*
 func (w *Writer) Alert(m string) (err error)
-func (w *Writer) Close() error
 func (w *Writer) Crit(m string) (err error)
 func (w *Writer) Debug(m string) (err error)
 func (w *Writer) Emerg(m string) (err error)
@@ -126,16 +1416,203 @@ func (w *Writer) Notice(m string) (err error)
 func (w *Writer) Warning(m string) (err error)
 */
 
+// begin and end track the messages being sent on the root writer, which
+// derived writers send through.
+func (w *Writer) begin() {
+	r := w.root()
+	r.pendingMu.Lock()
+	r.pending++
+	r.pendingMu.Unlock()
+}
+
+func (w *Writer) end() {
+	r := w.root()
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	if r.pending--; r.pending == 0 && r.idle != nil {
+		close(r.idle)
+		r.idle = nil
+	}
+}
+
+// FlushContext waits for the messages being sent by other goroutines to
+// be handed to the network, or for ctx to be done, in which case it
+// returns ctx.Err().  On a writer derived with WithFields, it waits for
+// every message of the writer it was derived from.
+func (w *Writer) FlushContext(ctx context.Context) error {
+	r := w.root()
+	r.pendingMu.Lock()
+	if r.pending == 0 {
+		r.pendingMu.Unlock()
+		return nil
+	}
+	if r.idle == nil {
+		r.idle = make(chan struct{})
+	}
+	idle := r.idle
+	r.pendingMu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FlushOnSignal waits for the messages being written to be sent when the
+// process receives one of the given signals, os.Interrupt and SIGTERM by
+// default, like GraylogHook.FlushOnSignal does with its queue.  It waits
+// FlushTimeout at most, then raises the signal again with the handler
+// removed.
+func (w *Writer) FlushOnSignal(sig ...os.Signal) {
+	flushOnSignal(sig, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+		defer cancel()
+		w.FlushContext(ctx)
+	})
+}
+
+// Recover is meant to be deferred, as defer w.Recover(true), to send the
+// panic of the calling goroutine, with its stack trace, as an alert with
+// _panic set, before the process dies.  It waits for the messages being
+// written by other goroutines to be sent, FlushTimeout at most, then
+// panics again with the same value if rethrow is set.
+func (w *Writer) Recover(rethrow bool) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	m := w.root().newMessage([]byte(fmt.Sprintf("panic: %v\n\n%s", r, debug.Stack())), "", 0, "", "")
+	m.Level = 1 // alert
+	m.setExtra(AdditionalFieldPrefix+"panic", true)
+	if err := w.WriteMessage(m); err != nil {
+		w.reportError(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+	defer cancel()
+	w.FlushContext(ctx)
+
+	if rethrow {
+		panic(r)
+	}
+}
+
+// Filtered returns the number of messages dropped by Filter.  On a
+// writer derived with WithFields, it counts those of the writer it was
+// derived from.
+func (w *Writer) Filtered() uint64 {
+	r := w.root()
+	r.filteredMu.Lock()
+	defer r.filteredMu.Unlock()
+	return r.filtered
+}
+
+// Close closes the connection of the transport, when it has one, after
+// sending the shutdown marker with SendShutdownMarker.  It does nothing
+// on writers derived with WithFields, which share the transport.
+func (w *Writer) Close() error {
+	if w.parent != nil {
+		// the transport belongs to the writer it was derived from
+		return nil
+	}
+	if w.SendShutdownMarker {
+		w.shutdownOnce.Do(func() {
+			m := w.newMessage([]byte("shutdown"), "", 0, "", "")
+			m.setExtra(AdditionalFieldPrefix+"shutdown", true)
+			w.WriteMessage(m)
+		})
+	}
+	if c, ok := w.Transport.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Shutdown flushes the writer with FlushContext, then closes it, so that
+// it can be deferred for a bounded graceful teardown.  The connection is
+// closed even if ctx is done before the flush completes.
+func (w *Writer) Shutdown(ctx context.Context) error {
+	err := w.FlushContext(ctx)
+	if cerr := w.Close(); cerr != nil {
+		if err != nil {
+			return fmt.Errorf("gelf: flush: %s, close: %s", err, cerr)
+		}
+		return cerr
+	}
+	return err
+}
+
 // Write encodes the given string in a GELF message and sends it to
 // the server specified in New().
 func (w *Writer) Write(p []byte) (n int, err error) {
 
 	// 1 for the function that called us.
-	file, line := getCallerIgnoringLogMulti(1)
+	file, line, function := getCallerIgnoringLogMulti(1)
+	var fingerprint string
+	if cfg := w.root(); cfg.IncludeStackHash {
+		fingerprint = stackFingerprint(1, cfg.StackHashFrames)
+	}
 
 	// remove trailing and leading whitespace
 	p = bytes.TrimSpace(p)
 
+	if max := w.root().MaxInputBytes; max > 0 && len(p) > max {
+		return w.writeSplit(p, file, line, function, fingerprint)
+	}
+
+	if err = w.WriteMessage(w.root().newMessage(p, file, line, function, fingerprint)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// writeSplit sends an input larger than MaxInputBytes as several
+// messages, sharing a random _split_id and numbered by _split_index.
+func (w *Writer) writeSplit(p []byte, file string, line int, function, fingerprint string) (n int, err error) {
+	cfg := w.root()
+	var parts [][]byte
+	for rest := p; len(rest) > 0; {
+		end := cfg.MaxInputBytes
+		if end >= len(rest) {
+			end = len(rest)
+		} else {
+			// don't cut a multi-byte character in half
+			for end > 0 && !utf8.RuneStart(rest[end]) {
+				end--
+			}
+			if end == 0 {
+				end = cfg.MaxInputBytes
+			}
+		}
+		parts = append(parts, rest[:end])
+		rest = rest[end:]
+	}
+
+	id := make([]byte, 8)
+	if _, err = io.ReadFull(rand.Reader, id); err != nil {
+		return 0, err
+	}
+	splitID := hex.EncodeToString(id)
+
+	for i, part := range parts {
+		m := cfg.newMessage(part, file, line, function, fingerprint)
+		m.setExtra(AdditionalFieldPrefix+"split_id", splitID)
+		m.setExtra(AdditionalFieldPrefix+"split_index", i)
+		m.setExtra(AdditionalFieldPrefix+"split_total", len(parts))
+		if err = w.WriteMessage(m); err != nil {
+			return n, err
+		}
+		n += len(part)
+	}
+
+	return n, nil
+}
+
+// newMessage builds the message sent by Write for the given input.
+func (w *Writer) newMessage(p []byte, file string, line int, function, fingerprint string) *Message {
 	// If there are newlines in the message, use the first line
 	// for the short message and set the full message to the
 	// original input.  If the input has no newlines, stick the
@@ -145,6 +1622,9 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	if i := bytes.IndexRune(p, '\n'); i > 0 {
 		short = p[:i]
 		full = p
+		if w.ShortFromLastLine {
+			short = lastLine(p)
+		}
 	}
 
 	m := Message{
@@ -154,42 +1634,240 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 		Full:     string(full),
 		TimeUnix: float64(time.Now().UnixNano()/1000000) / 1000.,
 		Level:    6, // info
-		Facility: w.Facility,
+		Facility: w.facility(),
 		File:     file,
 		Line:     line,
 		Extra:    map[string]interface{}{},
 	}
+	if w.IncludeFunc {
+		setFuncFields(&m, function)
+	}
+	if fingerprint != "" {
+		m.setExtra(AdditionalFieldPrefix+"fingerprint", fingerprint)
+	}
 
-	if err = w.WriteMessage(&m); err != nil {
-		return 0, err
+	return &m
+}
+
+// lastLine returns the last line of p which isn't blank.
+func lastLine(p []byte) []byte {
+	for len(p) > 0 {
+		i := bytes.LastIndexByte(p, '\n')
+		if line := bytes.TrimSpace(p[i+1:]); len(line) > 0 {
+			return line
+		}
+		if i < 0 {
+			break
+		}
+		p = p[:i]
 	}
+	return p
+}
 
-	return len(p), nil
+// WithFields returns a writer adding the given fields to every message
+// which doesn't set them already, like a request id in an HTTP handler.
+// The derived writer sends through w, with its transport and settings,
+// and leaves w unaffected: its own exported fields are ignored.  Closing
+// the derived writer does nothing, close w once done with every writer
+// derived from it.
+func (w *Writer) WithFields(fields map[string]interface{}) *Writer {
+	merged := make(map[string]interface{}, len(w.fields)+len(fields))
+	for k, v := range w.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[prefixKey(k)] = v
+	}
+	derived := &Writer{parent: w.root(), fields: merged}
+	if w.parent != nil {
+		derived.FieldPrefix = w.FieldPrefix
+	}
+	return derived
+}
+
+// root returns the writer holding the settings, which is the parent of
+// writers derived with WithFields.
+func (w *Writer) root() *Writer {
+	if w.parent != nil {
+		return w.parent
+	}
+	return w
+}
+
+// setExtra sets an additional field, allocating Extra if needed.
+func (m *Message) setExtra(k string, v interface{}) {
+	if m.Extra == nil {
+		m.Extra = make(map[string]interface{}, 1)
+	}
+	m.Extra[k] = v
+}
+
+// AddNumber sets the additional field key to n, which is always sent as
+// a JSON number, so that Graylog maps the field as numeric.  The key is
+// prefixed with AdditionalFieldPrefix if needed.  NaN and infinities,
+// which JSON can't represent, are not added.
+func (m *Message) AddNumber(key string, n float64) {
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return
+	}
+	m.setExtra(prefixKey(key), n)
+}
+
+// AddString sets the additional field key to v, which is always sent as
+// a JSON string, even when it looks like a number.  The key is prefixed
+// with AdditionalFieldPrefix if needed.
+func (m *Message) AddString(key, v string) {
+	m.setExtra(prefixKey(key), v)
 }
 
-// MarshalJSON converts a Message to JSON bytes.
+// prefixKey returns the key prefixed with AdditionalFieldPrefix.
+func prefixKey(key string) string {
+	if strings.HasPrefix(key, AdditionalFieldPrefix) {
+		return key
+	}
+	return AdditionalFieldPrefix + key
+}
+
+// prefixFields inserts FieldPrefix in the additional field keys of m
+// which don't have it yet.
+func (w *Writer) prefixFields(m *Message) {
+	if w.FieldPrefix == "" || len(m.Extra) == 0 {
+		return
+	}
+	prefix := AdditionalFieldPrefix + strings.TrimPrefix(w.FieldPrefix, AdditionalFieldPrefix)
+	for k, v := range m.Extra {
+		if strings.HasPrefix(k, prefix) {
+			continue
+		}
+		delete(m.Extra, k)
+		m.Extra[prefix+strings.TrimPrefix(k, AdditionalFieldPrefix)] = v
+	}
+}
+
+// SetFacility changes the facility of the messages sent by Write.
+// Unlike assigning Facility, it is safe while other goroutines write.
+func (w *Writer) SetFacility(facility string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.Facility = facility
+}
+
+func (w *Writer) facility() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.Facility
+}
+
+// MarshalJSON converts a Message to JSON bytes.  The additional fields
+// follow the standard fields, sorted by key when the message was sent
+// by a writer with SortKeys.
 func (m *Message) MarshalJSON() ([]byte, error) {
 	var err error
-	var b, eb []byte
+	var b []byte
+
+	if m.dialect == DialectGELF09 {
+		b, err = json.Marshal(m.legacy())
+	} else {
+		inner := innerMessage(*m)
+		if inner.Full == inner.Short {
+			// a full message repeating the short one only wastes bytes
+			inner.Full = ""
+		}
+		b, err = json.Marshal(&inner)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	extra := m.Extra
-	b, err = json.Marshal((*innerMessage)(m))
-	m.Extra = extra
+	fields, err := objectMembers(b)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(extra) == 0 {
-		return b, nil
+	// compose the standard fields and the extra fields in a single
+	// object
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	buf.Write(fields)
+
+	extra := prefixedExtra(m.Extra)
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
 	}
+	if m.sortKeys {
+		sort.Strings(keys)
+	}
+	for _, k := range keys {
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		vb, err := json.Marshal(extra[k])
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
 
-	if eb, err = json.Marshal(extra); err != nil {
-		return nil, err
+// objectMembers returns the members of a serialized JSON object, without
+// the surrounding braces, which is empty for an empty object.
+func objectMembers(b []byte) ([]byte, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) < 2 || b[0] != '{' || b[len(b)-1] != '}' {
+		return nil, fmt.Errorf("gelf: expected a JSON object, got %q", b)
 	}
+	return bytes.TrimSpace(b[1 : len(b)-1]), nil
+}
 
-	// merge serialized message + serialized extra map
-	b[len(b)-1] = ','
-	return append(b, eb[1:len(eb)]...), nil
+// legacy returns the GELF 0.9 form of the message, whose single message
+// field holds the full message, or the short one when there is none.
+func (m *Message) legacy() *legacyMessage {
+	msg := m.Full
+	if msg == "" {
+		msg = m.Short
+	}
+	return &legacyMessage{
+		Version:  m.Version,
+		Host:     m.Host,
+		Message:  msg,
+		TimeUnix: m.TimeUnix,
+		Level:    m.Level,
+		Facility: m.Facility,
+		File:     m.File,
+		Line:     m.Line,
+	}
+}
+
+// prefixedExtra returns the extra fields with AdditionalFieldPrefix added
+// to the keys lacking it.  The map is only copied if a key has to change.
+func prefixedExtra(extra map[string]interface{}) map[string]interface{} {
+	var prefixed map[string]interface{}
+	for k := range extra {
+		if !strings.HasPrefix(k, AdditionalFieldPrefix) {
+			prefixed = make(map[string]interface{}, len(extra))
+			break
+		}
+	}
+	if prefixed == nil {
+		return extra
+	}
+
+	for k, v := range extra {
+		if !strings.HasPrefix(k, AdditionalFieldPrefix) {
+			k = AdditionalFieldPrefix + k
+		}
+		prefixed[k] = v
+	}
+	return prefixed
 }
 
 // UnmarshalJSON converts writes some bytes into a Message.
@@ -198,14 +1876,9 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &i); err != nil {
 		return err
 	}
+	// standard fields are matched first, as every key has an empty
+	// AdditionalFieldPrefix
 	for k, v := range i {
-		if k[0] == '_' {
-			if m.Extra == nil {
-				m.Extra = make(map[string]interface{}, 1)
-			}
-			m.Extra[k] = v
-			continue
-		}
 		switch k {
 		case "version":
 			m.Version = v.(string)
@@ -225,6 +1898,13 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 			m.File = v.(string)
 		case "line":
 			m.Line = int(v.(float64))
+		default:
+			if strings.HasPrefix(k, AdditionalFieldPrefix) {
+				if m.Extra == nil {
+					m.Extra = make(map[string]interface{}, 1)
+				}
+				m.Extra[k] = v
+			}
 		}
 	}
 	return nil
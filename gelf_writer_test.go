@@ -0,0 +1,1701 @@
+package graylog
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// captureTransport records the messages it is asked to send.
+type captureTransport struct {
+	mu   sync.Mutex
+	msgs []*Message
+}
+
+func (t *captureTransport) WriteMessage(m *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.msgs = append(t.msgs, m)
+	return nil
+}
+
+func (t *captureTransport) last() *Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.msgs) == 0 {
+		return nil
+	}
+	return t.msgs[len(t.msgs)-1]
+}
+
+func newCaptureWriter() (*Writer, *captureTransport) {
+	t := &captureTransport{}
+	return &Writer{Transport: t, hostname: "testing.local", Facility: "test"}, t
+}
+
+func TestHostAsIP(t *testing.T) {
+	defer func(f func() (net.IP, error)) { outboundIP = f }(outboundIP)
+	calls := 0
+	outboundIP = func() (net.IP, error) {
+		calls++
+		return net.ParseIP("10.1.2.3"), nil
+	}
+
+	w, ct := newCaptureWriter()
+	w.HostAsIP = true
+	w.Write([]byte("first"))
+	w.Write([]byte("second"))
+
+	if host := ct.last().Host; host != "10.1.2.3" {
+		t.Errorf("Host should be the outbound IP (exp: 10.1.2.3, got: %s)", host)
+	}
+	if calls != 1 {
+		t.Errorf("outbound IP should be determined once, got %d calls", calls)
+	}
+}
+
+func TestHostAsIPFallback(t *testing.T) {
+	defer func(f func() (net.IP, error)) { outboundIP = f }(outboundIP)
+	outboundIP = func() (net.IP, error) {
+		return nil, errors.New("network unreachable")
+	}
+
+	w, ct := newCaptureWriter()
+	w.HostAsIP = true
+	w.Write([]byte("message"))
+
+	if host := ct.last().Host; host != "testing.local" {
+		t.Errorf("Host should fall back to the hostname (exp: testing.local, got: %s)", host)
+	}
+}
+
+func TestDefaultHostAsIP(t *testing.T) {
+	defer func(f func() (net.IP, error)) { outboundIP = f }(outboundIP)
+	calls := 0
+	outboundIP = func() (net.IP, error) {
+		calls++
+		return net.ParseIP("10.1.2.3"), nil
+	}
+	DefaultHostAsIP = true
+	defer func() { DefaultHostAsIP = false }()
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	if calls != 1 {
+		t.Errorf("NewWriter should determine the outbound IP, got %d calls", calls)
+	}
+
+	w.Write([]byte("message"))
+	m, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if m.Host != "10.1.2.3" || calls != 1 {
+		t.Errorf("expected the outbound IP determined by NewWriter, got %s after %d calls", m.Host, calls)
+	}
+}
+
+func TestFacilityByVersion(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		version  string
+		force    *bool
+		facility string
+	}{
+		{"1.0", nil, "test"},
+		{"1.1", nil, ""},
+		{"1.1", &yes, "test"},
+		{"1.0", &no, ""},
+	}
+
+	for _, tt := range tests {
+		w, ct := newCaptureWriter()
+		w.GELFVersion = tt.version
+		w.ForceFacility = tt.force
+		w.Write([]byte("message"))
+
+		m := ct.last()
+		if m.Version != tt.version {
+			t.Errorf("Version should match (exp: %s, got: %s)", tt.version, m.Version)
+		}
+		if m.Facility != tt.facility {
+			t.Errorf("version %s, force %v: facility expected %q, got %q", tt.version, tt.force, tt.facility, m.Facility)
+		}
+
+		b, err := m.MarshalJSON()
+		if err != nil {
+			t.Fatalf("MarshalJSON: %s", err)
+		}
+		if sent := strings.Contains(string(b), `"facility"`); sent != (tt.facility != "") {
+			t.Errorf("version %s, force %v: facility sent = %v in %s", tt.version, tt.force, sent, b)
+		}
+	}
+}
+
+func TestIncludeGoroutineID(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.IncludeGoroutineID = true
+	w.Write([]byte("message"))
+
+	id, ok := ct.last().Extra["_goroutine"].(int64)
+	if !ok {
+		t.Fatalf("_goroutine should be an integer, got %#v", ct.last().Extra["_goroutine"])
+	}
+	if id <= 0 {
+		t.Errorf("_goroutine should be positive, got %d", id)
+	}
+}
+
+func TestDurationFormat(t *testing.T) {
+	tests := []struct {
+		format   DurationFormat
+		expected string
+	}{
+		{DurationNanoseconds, `"_took":1500000000`},
+		{DurationSeconds, `"_took":1.5`},
+		{DurationString, `"_took":"1.5s"`},
+	}
+
+	at := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+	for _, tt := range tests {
+		w, ct := newCaptureWriter()
+		w.DurationFormat = tt.format
+		w.WriteMessage(&Message{
+			Version: "1.1",
+			Short:   "message",
+			Extra: map[string]interface{}{
+				"_took": 1500 * time.Millisecond,
+				"_at":   at,
+			},
+		})
+
+		b, err := ct.last().MarshalJSON()
+		if err != nil {
+			t.Fatalf("MarshalJSON: %s", err)
+		}
+		if !strings.Contains(string(b), tt.expected) {
+			t.Errorf("duration format %d: expected %s in %s", tt.format, tt.expected, b)
+		}
+		if !strings.Contains(string(b), `"_at":"2017-06-01T12:30:00Z"`) {
+			t.Errorf("time should be sent as RFC3339, got %s", b)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		compression CompressType
+		magic       []byte
+	}{
+		{CompressGzip, magicGzip},
+		{CompressZlib, magicZlib},
+		{NoCompress, []byte("{")},
+	}
+
+	for _, tt := range tests {
+		w, ct := newCaptureWriter()
+		w.CompressionType = tt.compression
+		w.CompressionLevel = flate.BestSpeed
+
+		b, err := w.Encode(&Message{Version: "1.1", Host: "testing.local", Short: "message"})
+		if err != nil {
+			t.Fatalf("Encode: %s", err)
+		}
+		if !bytes.HasPrefix(b, tt.magic) {
+			t.Errorf("compression %d: expected magic %x, got %x", tt.compression, tt.magic, b[:2])
+		}
+		if len(ct.msgs) != 0 {
+			t.Errorf("Encode should not send the message")
+		}
+	}
+}
+
+func TestEncodeDerived(t *testing.T) {
+	w, _ := newCaptureWriter()
+	w.CompressionType = CompressZlib
+	w.CompressionLevel = flate.BestSpeed
+	w.SortKeys = true
+	derived := w.WithFields(map[string]interface{}{"request": "42"})
+
+	m := &Message{Version: "1.1", Host: "testing.local", Short: "message", Extra: map[string]interface{}{"_b": 1, "_a": 2}}
+	exp, err := w.Encode(m)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	got, err := derived.Encode(m)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if !bytes.Equal(got, exp) {
+		t.Errorf("derived writers should encode with the root settings, got %x, expected %x", got, exp)
+	}
+}
+
+func TestCollapseWhitespace(t *testing.T) {
+	input := "id\t\tname    value\n\n  1\t   foo  \t bar\n2 baz qux"
+
+	w, ct := newCaptureWriter()
+	w.CollapseWhitespace = true
+	w.Write([]byte(input))
+
+	m := ct.last()
+	if m.Short != "id name value" {
+		t.Errorf("msg.Short: expected %q, got %q", "id name value", m.Short)
+	}
+	expected := "id name value\n1 foo bar\n2 baz qux"
+	if m.Full != expected {
+		t.Errorf("msg.Full: expected %q, got %q", expected, m.Full)
+	}
+
+	if s := collapseWhitespace("  leading and trailing \t", false); s != "leading and trailing" {
+		t.Errorf("leading and trailing whitespace should be dropped, got %q", s)
+	}
+
+	w, ct = newCaptureWriter()
+	w.Write([]byte(input))
+	if ct.last().Full != input {
+		t.Errorf("whitespace should be kept when disabled, got %q", ct.last().Full)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.Environment = "staging"
+	w.Write([]byte("message"))
+
+	if env := ct.last().Extra["_environment"]; env != "staging" {
+		t.Errorf("_environment should match (exp: staging, got: %v)", env)
+	}
+}
+
+func TestEnvironmentFromEnv(t *testing.T) {
+	defer os.Setenv("GO_ENV", os.Getenv("GO_ENV"))
+	defer os.Setenv("APP_ENV", os.Getenv("APP_ENV"))
+
+	os.Setenv("GO_ENV", "")
+	os.Setenv("APP_ENV", "dev")
+	if env := NewDiscardWriter().Environment; env != "dev" {
+		t.Errorf("Environment should default to APP_ENV (exp: dev, got: %s)", env)
+	}
+
+	os.Setenv("GO_ENV", "prod")
+	if env := NewDiscardWriter().Environment; env != "prod" {
+		t.Errorf("GO_ENV should take precedence (exp: prod, got: %s)", env)
+	}
+
+	os.Setenv("GO_ENV", "")
+	os.Setenv("APP_ENV", "")
+	w, ct := newCaptureWriter()
+	w.Write([]byte("message"))
+	if _, ok := ct.last().Extra["_environment"]; ok {
+		t.Error("_environment should not be sent when no environment is set")
+	}
+}
+
+func TestAdditionalFieldPrefix(t *testing.T) {
+	m := &Message{
+		Version: "1.1",
+		Short:   "message",
+		Extra:   map[string]interface{}{"_prefixed": "1", "unprefixed": "2"},
+	}
+
+	b, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+	for _, field := range []string{`"_prefixed":"1"`, `"_unprefixed":"2"`} {
+		if !strings.Contains(string(b), field) {
+			t.Errorf("expected %s in %s", field, b)
+		}
+	}
+	if _, ok := m.Extra["unprefixed"]; !ok {
+		t.Error("MarshalJSON should not modify the extra fields")
+	}
+
+	defer func(p string) { AdditionalFieldPrefix = p }(AdditionalFieldPrefix)
+	AdditionalFieldPrefix = "@"
+	if b, err = m.MarshalJSON(); err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+	if !strings.Contains(string(b), `"@unprefixed":"2"`) {
+		t.Errorf("expected the configured prefix in %s", b)
+	}
+
+	var decoded Message
+	if err := decoded.UnmarshalJSON(b); err != nil {
+		t.Fatalf("UnmarshalJSON: %s", err)
+	}
+	if decoded.Extra["@unprefixed"] != "2" {
+		t.Errorf("UnmarshalJSON should use the configured prefix, got %v", decoded.Extra)
+	}
+}
+
+func TestEmptyAdditionalFieldPrefix(t *testing.T) {
+	defer func(p string) { AdditionalFieldPrefix = p }(AdditionalFieldPrefix)
+	AdditionalFieldPrefix = ""
+
+	m := &Message{
+		Version:  "1.1",
+		Host:     "testing.local",
+		Short:    "message",
+		Full:     "full message",
+		TimeUnix: 1.5,
+		Level:    3,
+		Facility: "test",
+		Extra:    map[string]interface{}{"user": "alice"},
+	}
+	b, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+
+	var decoded Message
+	if err := decoded.UnmarshalJSON(b); err != nil {
+		t.Fatalf("UnmarshalJSON: %s", err)
+	}
+	if decoded.Short != "message" || decoded.Host != "testing.local" || decoded.Level != 3 || decoded.TimeUnix != 1.5 {
+		t.Errorf("standard fields were not decoded: %+v", decoded)
+	}
+	if len(decoded.Extra) != 1 || decoded.Extra["user"] != "alice" {
+		t.Errorf("expected only the additional field in Extra, got %v", decoded.Extra)
+	}
+}
+
+func TestSetFacility(t *testing.T) {
+	w, ct := newCaptureWriter()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.Write([]byte("message"))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		w.SetFacility("reloaded")
+	}
+	wg.Wait()
+
+	w.Write([]byte("message"))
+	if f := ct.last().Facility; f != "reloaded" {
+		t.Errorf("Facility should match (exp: reloaded, got: %s)", f)
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	w, _ := newCaptureWriter()
+	w.CompressionLevel = flate.DefaultCompression
+	if l := w.compressionLevel(16 * ChunkSize); l != flate.DefaultCompression {
+		t.Errorf("CompressionLevel should be used when not adaptive, got %d", l)
+	}
+
+	w.AdaptiveCompression = true
+	tests := []struct {
+		size  int
+		level int
+	}{
+		{100, flate.BestSpeed},
+		{ChunkSize, flate.BestSpeed},
+		{4 * ChunkSize, flate.DefaultCompression},
+		{8 * ChunkSize, flate.BestCompression},
+	}
+	for _, tt := range tests {
+		if l := w.compressionLevel(tt.size); l != tt.level {
+			t.Errorf("size %d: expected level %d, got %d", tt.size, tt.level, l)
+		}
+	}
+
+	w.AdaptiveSmallSize, w.AdaptiveLargeSize = 10, 20
+	if l := w.compressionLevel(15); l != flate.DefaultCompression {
+		t.Errorf("configured thresholds should be used, got level %d", l)
+	}
+	if l := w.compressionLevel(20); l != flate.BestCompression {
+		t.Errorf("configured thresholds should be used, got level %d", l)
+	}
+}
+
+func BenchmarkAdaptiveCompression(b *testing.B) {
+	small := &Message{Version: "1.1", Host: "testing.local", Short: "user logged in"}
+	large := &Message{Version: "1.1", Host: "testing.local", Short: strings.Repeat("user logged in, ", 2000)}
+
+	for _, adaptive := range []bool{false, true} {
+		w, _ := newCaptureWriter()
+		w.CompressionLevel = flate.DefaultCompression
+		w.AdaptiveCompression = adaptive
+		for name, m := range map[string]*Message{"small": small, "large": large} {
+			b.Run(fmt.Sprintf("adaptive=%v/%s", adaptive, name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					w.Encode(m)
+				}
+			})
+		}
+	}
+}
+
+func TestEmptyFacility(t *testing.T) {
+	defer func(f func() (*debug.BuildInfo, bool)) { readBuildInfo = f }(readBuildInfo)
+	readBuildInfo = func() (*debug.BuildInfo, bool) { return nil, false }
+
+	w, ct := newCaptureWriter()
+	w.SetFacility("")
+	w.Write([]byte("message"))
+
+	if f := ct.last().Facility; f != path.Base(os.Args[0]) {
+		t.Errorf("empty facility should default to the process name (exp: %s, got: %s)", path.Base(os.Args[0]), f)
+	}
+
+	w.GELFVersion = "1.1"
+	w.Write([]byte("message"))
+	if f := ct.last().Facility; f != "" {
+		t.Errorf("facility should not be sent in GELF 1.1, got %s", f)
+	}
+}
+
+func TestModule(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.Module = "github.com/example/monorepo/billing"
+	w.Write([]byte("message"))
+
+	if mod := ct.last().Extra["_module"]; mod != "github.com/example/monorepo/billing" {
+		t.Errorf("_module should match (exp: github.com/example/monorepo/billing, got: %v)", mod)
+	}
+}
+
+func TestModuleFromBuildInfo(t *testing.T) {
+	defer func(f func() (*debug.BuildInfo, bool)) { readBuildInfo = f }(readBuildInfo)
+
+	readBuildInfo = func() (*debug.BuildInfo, bool) {
+		return &debug.BuildInfo{Main: debug.Module{Path: "github.com/example/service"}}, true
+	}
+	w, ct := newCaptureWriter()
+	w.Write([]byte("message"))
+	if _, ok := ct.last().Extra["_module"]; ok {
+		t.Error("_module should not be sent unless enabled")
+	}
+
+	w.ModuleFromBuildInfo = true
+	w.Write([]byte("message"))
+	if mod := ct.last().Extra["_module"]; mod != "github.com/example/service" {
+		t.Errorf("_module should be the main module (exp: github.com/example/service, got: %v)", mod)
+	}
+
+	w.Module = "billing"
+	w.Write([]byte("message"))
+	if mod := ct.last().Extra["_module"]; mod != "billing" {
+		t.Errorf("Module should take precedence over build info (exp: billing, got: %v)", mod)
+	}
+
+	readBuildInfo = func() (*debug.BuildInfo, bool) { return nil, false }
+	w, ct = newCaptureWriter()
+	w.ModuleFromBuildInfo = true
+	w.Write([]byte("message"))
+	if _, ok := ct.last().Extra["_module"]; ok {
+		t.Error("_module should not be sent without build info")
+	}
+}
+
+func TestShortMessageTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		short    string
+	}{
+		{"[{{.service}}] {{.event}}: {{.short_message}}", "[billing] invoice_sent: invoice 42 sent"},
+		{"[{{.service}}] {{.missing}}", "invoice 42 sent"},
+		{"{{.service", "invoice 42 sent"},
+		{"{{if false}}never{{end}}", "invoice 42 sent"},
+	}
+
+	for _, tt := range tests {
+		w, ct := newCaptureWriter()
+		w.ShortMessageTemplate = tt.template
+		w.WriteMessage(&Message{
+			Version: "1.1",
+			Short:   "invoice 42 sent",
+			Extra:   map[string]interface{}{"_service": "billing", "_event": "invoice_sent"},
+		})
+
+		if short := ct.last().Short; short != tt.short {
+			t.Errorf("template %q: expected %q, got %q", tt.template, tt.short, short)
+		}
+	}
+}
+
+func TestNoTransport(t *testing.T) {
+	w := &Writer{}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "message"}); err != ErrNoTransport {
+		t.Errorf("expected ErrNoTransport, got %v", err)
+	}
+	if n, err := w.Write([]byte("message")); err != ErrNoTransport || n != 0 {
+		t.Errorf("expected ErrNoTransport and 0 bytes written, got %v and %d", err, n)
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	extra := map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		extra[fmt.Sprintf("_field%d", i)] = i
+	}
+	w, ct := newCaptureWriter()
+	w.SortKeys = true
+	w.WriteMessage(&Message{Version: "1.1", Host: "testing.local", Short: "message", Extra: extra})
+	m := ct.last()
+
+	first, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %s", err)
+	}
+	for i := 0; i < 20; i++ {
+		b, err := m.MarshalJSON()
+		if err != nil {
+			t.Fatalf("MarshalJSON: %s", err)
+		}
+		if !bytes.Equal(b, first) {
+			t.Fatalf("output should be identical across marshals:\n%s\n%s", first, b)
+		}
+	}
+	if !bytes.Contains(first, []byte(`"_field0":0,"_field1":1,"_field10":10`)) {
+		t.Errorf("extra fields should be sorted by key, got %s", first)
+	}
+}
+
+func TestMaxInputBytes(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.MaxInputBytes = 64 * 1024
+
+	input := bytes.Repeat([]byte("x"), 1024*1024)
+	n, err := w.Write(input)
+	if err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if n != len(input) {
+		t.Errorf("Write should report all bytes written (exp: %d, got %d)", len(input), n)
+	}
+
+	if len(ct.msgs) != 16 {
+		t.Fatalf("expected 16 messages, got %d", len(ct.msgs))
+	}
+	splitID := ct.msgs[0].Extra["_split_id"]
+	total := 0
+	for i, m := range ct.msgs {
+		if m.Extra["_split_id"] != splitID {
+			t.Errorf("message %d: _split_id should be shared (exp: %v, got %v)", i, splitID, m.Extra["_split_id"])
+		}
+		if m.Extra["_split_index"] != i {
+			t.Errorf("message %d: unexpected _split_index %v", i, m.Extra["_split_index"])
+		}
+		if m.Extra["_split_total"] != 16 {
+			t.Errorf("message %d: unexpected _split_total %v", i, m.Extra["_split_total"])
+		}
+		total += len(m.Short)
+	}
+	if total != len(input) {
+		t.Errorf("split messages should hold the whole input (exp: %d, got %d bytes)", len(input), total)
+	}
+
+	w.Write([]byte("short input"))
+	if _, ok := ct.last().Extra["_split_id"]; ok {
+		t.Error("inputs under MaxInputBytes should not be split")
+	}
+}
+
+func TestMaxInputBytesUTF8(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.MaxInputBytes = 5
+	w.Write([]byte("ééééé"))
+
+	for _, m := range ct.msgs {
+		if !utf8.ValidString(m.Short) {
+			t.Errorf("split should not cut characters, got %q", m.Short)
+		}
+	}
+}
+
+func TestDialectGELF09(t *testing.T) {
+	w, ct := newCaptureWriter()
+	if _, err := w.Write([]byte("legacy\nwith details")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	modern, err := json.Marshal(ct.last())
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+
+	w.Dialect = DialectGELF09
+	if _, err := w.Write([]byte("legacy\nwith details")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	legacy, err := json.Marshal(ct.last())
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if bytes.Equal(modern, legacy) {
+		t.Fatalf("GELF 0.9 serialization should differ from 1.x: %s", legacy)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(legacy, &fields); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if _, ok := fields["short_message"]; ok {
+		t.Errorf("GELF 0.9 has no short_message: %s", legacy)
+	}
+	if _, ok := fields["full_message"]; ok {
+		t.Errorf("GELF 0.9 has no full_message: %s", legacy)
+	}
+	if fields["message"] != "legacy\nwith details" {
+		t.Errorf("message: expected the full message, got %v", fields["message"])
+	}
+	if fields["version"] != "0.9" {
+		t.Errorf("version: expected 0.9, got %v", fields["version"])
+	}
+	if fields["facility"] != "test" {
+		t.Errorf("facility: expected test, got %v", fields["facility"])
+	}
+}
+
+func TestGuessScheme(t *testing.T) {
+	for _, tc := range []struct {
+		addr   string
+		scheme string
+	}{
+		{"graylog.example.com:443", "https"},
+		{"graylog.example.com:443/gelf", "https"},
+		{"graylog.example.com:80", "http"},
+		{"graylog.example.com:12201/gelf", "http"},
+		{"graylog.example.com:12201", "udp"},
+		{"127.0.0.1:12202", "udp"},
+		{"[::1]:443", "https"},
+		{"graylog.example.com:8080/gelf", ""},
+		{"graylog.example.com", ""},
+		{"graylog.example.com/gelf", ""},
+	} {
+		scheme, err := guessScheme(tc.addr)
+		if tc.scheme == "" {
+			if err == nil || !strings.Contains(err.Error(), "ambiguous") {
+				t.Errorf("%s: expected an ambiguous address error, got %q, %v", tc.addr, scheme, err)
+			}
+			continue
+		}
+		if err != nil || scheme != tc.scheme {
+			t.Errorf("%s: expected %s, got %q, %v", tc.addr, tc.scheme, scheme, err)
+		}
+	}
+}
+
+func TestNewWriterGuessScheme(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:443")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if _, ok := w.Transport.(*udpTransport); !ok {
+		t.Errorf("scheme-less addresses should use UDP by default, got %T", w.Transport)
+	}
+
+	GuessScheme = true
+	defer func() { GuessScheme = false }()
+
+	w, err = NewWriter("127.0.0.1:443")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if ht, ok := w.Transport.(*httpTransport); !ok || ht.url != "https://127.0.0.1:443" {
+		t.Errorf("expected an HTTPS transport, got %#v", w.Transport)
+	}
+
+	w, err = NewWriter("127.0.0.1:12201")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if _, ok := w.Transport.(*udpTransport); !ok {
+		t.Errorf("expected a UDP transport, got %T", w.Transport)
+	}
+
+	if _, err := NewWriter("127.0.0.1:8080/gelf"); err == nil {
+		t.Error("ambiguous addresses should be refused")
+	}
+}
+
+// closingTransport holds every message until it is released, and
+// records whether it was closed.
+type closingTransport struct {
+	blockingTransport
+	sent   chan struct{}
+	closed chan struct{}
+}
+
+func newClosingTransport() *closingTransport {
+	return &closingTransport{
+		blockingTransport: blockingTransport{release: make(chan struct{})},
+		sent:              make(chan struct{}, 1),
+		closed:            make(chan struct{}),
+	}
+}
+
+func (t *closingTransport) WriteMessage(m *Message) error {
+	t.blockingTransport.WriteMessage(m)
+	t.sent <- struct{}{}
+	return nil
+}
+
+func (t *closingTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	ct := newClosingTransport()
+	w := &Writer{Transport: ct}
+
+	done := make(chan error)
+	go func() {
+		_, err := w.Write([]byte("in flight"))
+		done <- err
+	}()
+	for w.pendingCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(ct.release)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+
+	select {
+	case <-ct.sent:
+	default:
+		t.Error("Shutdown should wait for the message in flight")
+	}
+	select {
+	case <-ct.closed:
+	default:
+		t.Error("Shutdown should close the transport")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Write: %s", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ct := newClosingTransport()
+	w := &Writer{Transport: ct}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Write([]byte("stuck"))
+	}()
+	defer func() {
+		// don't leave the write running into the next tests
+		close(ct.release)
+		<-done
+	}()
+	for w.pendingCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := w.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown should return when the context is done, took %s", elapsed)
+	}
+	select {
+	case <-ct.closed:
+	default:
+		t.Error("Shutdown should close the transport even after a timeout")
+	}
+}
+
+func (w *Writer) pendingCount() int {
+	r := w.root()
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	return r.pending
+}
+
+func TestRedactPatterns(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.RedactPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\b\d(?:[ -]?\d){12,15}\b`),
+		regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.]+`),
+	}
+
+	m := &Message{
+		Version: "1.1",
+		Short:   "payment with 4111 1111 1111 1111 declined",
+		Full:    "payment with 4111 1111 1111 1111 declined\nnotified jane@example.com",
+		Extra: map[string]interface{}{
+			"_card":   "4111-1111-1111-1111",
+			"_note":   "contact jane@example.com",
+			"_amount": 42,
+			"_order":  "1234",
+		},
+	}
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	got := ct.last()
+	if got.Short != "payment with *** declined" {
+		t.Errorf("Short: got %q", got.Short)
+	}
+	if got.Full != "payment with *** declined\nnotified ***" {
+		t.Errorf("Full: got %q", got.Full)
+	}
+	if got.Extra["_card"] != "***" || got.Extra["_note"] != "contact ***" {
+		t.Errorf("string fields should be redacted, got %v", got.Extra)
+	}
+	if got.Extra["_amount"] != 42 || got.Extra["_order"] != "1234" {
+		t.Errorf("other fields should be kept, got %v", got.Extra)
+	}
+}
+
+func TestCustomGELFVersion(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.GELFVersion = "1.1-routing-eu"
+	if _, err := w.Write([]byte("routed")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	b, err := json.Marshal(ct.last())
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if !bytes.Contains(b, []byte(`"version":"1.1-routing-eu"`)) {
+		t.Errorf("expected the custom version, got %s", b)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		facility string
+	}{
+		{"routing-eu", ""},
+		{"1.1-routing-eu", ""},
+		{"1.0-routing-eu", "test"},
+	}
+	for _, tt := range tests {
+		w, ct := newCaptureWriter()
+		w.GELFVersion = tt.version
+		if _, err := w.Write([]byte("routed")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		b, err := json.Marshal(ct.last())
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		if !bytes.Contains(b, []byte(`"version":"`+tt.version+`"`)) {
+			t.Errorf("expected version %s, got %s", tt.version, b)
+		}
+		if f := ct.last().Facility; f != tt.facility {
+			t.Errorf("version %s: facility expected %q, got %q", tt.version, tt.facility, f)
+		}
+	}
+
+	w, _ := newCaptureWriter()
+	for _, blank := range []string{" ", "\t\n"} {
+		w.GELFVersion = blank
+		if err := w.WriteMessage(&Message{Short: "routed"}); err != ErrBlankVersion {
+			t.Errorf("GELFVersion %q: expected ErrBlankVersion, got %v", blank, err)
+		}
+	}
+}
+
+func TestOmitRedundantFullMessage(t *testing.T) {
+	for _, full := range []string{"", "same"} {
+		b, err := json.Marshal(&Message{Version: "1.1", Short: "same", Full: full})
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		if bytes.Contains(b, []byte("full_message")) {
+			t.Errorf("full message %q should be omitted: %s", full, b)
+		}
+	}
+
+	b, err := json.Marshal(&Message{Version: "1.1", Short: "short", Full: "short\nand long"})
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if !bytes.Contains(b, []byte(`"full_message":"short\nand long"`)) {
+		t.Errorf("a distinct full message should be kept: %s", b)
+	}
+}
+
+func TestMarshalJSONComposition(t *testing.T) {
+	for _, m := range []*Message{
+		{},
+		{Extra: map[string]interface{}{"_only": "extra", "nested": map[string]int{"a": 1}}},
+		{Version: "1.1", Short: "no extra", Extra: map[string]interface{}{}},
+	} {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			t.Fatalf("invalid JSON %s: %s", b, err)
+		}
+		if len(fields) != 7+len(m.Extra) {
+			t.Errorf("expected %d fields, got %s", 7+len(m.Extra), b)
+		}
+	}
+}
+
+func TestObjectMembers(t *testing.T) {
+	for in, want := range map[string]string{
+		`{}`:            ``,
+		` { } `:         ``,
+		`{"a":1,"b":2}`: `"a":1,"b":2`,
+	} {
+		got, err := objectMembers([]byte(in))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: expected %q, got %q, %v", in, want, got, err)
+		}
+	}
+	for _, in := range []string{``, `null`, `[1]`, `{`} {
+		if _, err := objectMembers([]byte(in)); err == nil {
+			t.Errorf("%s: should be refused", in)
+		}
+	}
+}
+
+func TestWithFields(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.IncludeFunc = true
+	child := w.WithFields(map[string]interface{}{"request_id": "r-1", "_user": "jane"})
+	grandchild := child.WithFields(map[string]interface{}{"user": "john"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			child.Write([]byte("child"))
+		}()
+		go func() {
+			defer wg.Done()
+			w.Write([]byte("parent"))
+		}()
+	}
+	wg.Wait()
+
+	ct.mu.Lock()
+	for _, m := range ct.msgs {
+		switch m.Short {
+		case "child":
+			if m.Extra["_request_id"] != "r-1" || m.Extra["_user"] != "jane" {
+				t.Errorf("child fields missing: %v", m.Extra)
+			}
+			if m.Host != "testing.local" || m.Facility != "test" || m.Extra["_func"] == nil {
+				t.Errorf("child should use the settings of the parent: %+v", m)
+			}
+		case "parent":
+			if _, ok := m.Extra["_request_id"]; ok {
+				t.Errorf("parent should be unaffected: %v", m.Extra)
+			}
+		}
+	}
+	ct.mu.Unlock()
+
+	if _, err := grandchild.Write([]byte("grandchild")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if m := ct.last(); m.Extra["_request_id"] != "r-1" || m.Extra["_user"] != "john" {
+		t.Errorf("derived writers should add their fields to their parent's: %v", m.Extra)
+	}
+
+	m := &Message{Version: "1.1", Short: "own", Extra: map[string]interface{}{"_user": "set"}}
+	if err := child.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if m.Extra["_user"] != "set" {
+		t.Errorf("fields of the message should win, got %v", m.Extra["_user"])
+	}
+}
+
+func TestWithFieldsShutdown(t *testing.T) {
+	ct := newClosingTransport()
+	w := &Writer{Transport: ct}
+	child := w.WithFields(map[string]interface{}{"request_id": "r-1"})
+
+	go child.Write([]byte("in flight"))
+	for child.pendingCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := child.FlushContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("the derived writer should wait for its messages, got %v", err)
+	}
+	close(ct.release)
+	<-ct.sent
+
+	if err := child.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+	select {
+	case <-ct.closed:
+		t.Fatal("closing the derived writer should leave the shared transport open")
+	default:
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	<-ct.closed
+}
+
+func TestReservedFieldPolicy(t *testing.T) {
+	AdditionalFieldPrefix = ""
+	defer func() { AdditionalFieldPrefix = "_" }()
+
+	for _, tc := range []struct {
+		policy ReservedFieldPolicy
+		extra  map[string]interface{}
+		err    bool
+	}{
+		{ReservedRename, map[string]interface{}{"_host": "spoofed", "__id": 1, "user": "jane"}, false},
+		{ReservedDrop, map[string]interface{}{"user": "jane"}, false},
+		{ReservedError, nil, true},
+	} {
+		w, ct := newCaptureWriter()
+		w.ReservedFieldPolicy = tc.policy
+		m := &Message{
+			Version: "1.1",
+			Host:    "testing.local",
+			Short:   "collision",
+			Extra:   map[string]interface{}{"host": "spoofed", "_id": 1, "user": "jane"},
+		}
+
+		err := w.WriteMessage(m)
+		if tc.err {
+			if err == nil || !strings.Contains(err.Error(), "reserved") || len(ct.msgs) != 0 {
+				t.Errorf("policy %d: expected the message to be refused, got %v", tc.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("policy %d: WriteMessage: %s", tc.policy, err)
+		}
+		if fmt.Sprint(m.Extra) != fmt.Sprint(tc.extra) {
+			t.Errorf("policy %d: expected %v, got %v", tc.policy, tc.extra, m.Extra)
+		}
+
+		b, _ := json.Marshal(m)
+		if bytes.Count(b, []byte(`"host":`)) != 1 {
+			t.Errorf("policy %d: host should be sent once: %s", tc.policy, b)
+		}
+		if !bytes.Contains(b, []byte(`"host":"testing.local"`)) {
+			t.Errorf("policy %d: the standard host should be kept: %s", tc.policy, b)
+		}
+	}
+}
+
+func TestNumericSuffix(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.NumericSuffix = "_num"
+
+	m := &Message{
+		Version: "1.1",
+		Short:   "numbers",
+		Extra: map[string]interface{}{
+			"_latency_num":  12.5,
+			"_count_num":    "42",
+			"_ratio_num":    " 0.25 ",
+			"_invalid_num":  "n/a",
+			"_flag_num":     true,
+			"_name":         "42",
+			"_duration_num": 3 * time.Second,
+		},
+	}
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	got := ct.last().Extra
+	expected := map[string]interface{}{
+		"_latency_num":  12.5,
+		"_count_num":    int64(42),
+		"_ratio_num":    0.25,
+		"_name":         "42",
+		"_duration_num": 3 * time.Second,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: expected %v (%T), got %v (%T)", k, v, v, got[k], got[k])
+		}
+	}
+}
+
+func TestMarshalFallback(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	m := &Message{
+		Version:  "1.1",
+		Host:     "testing.local",
+		Short:    "unserializable",
+		TimeUnix: 1500000000,
+		Level:    3,
+		Extra:    map[string]interface{}{"_channel": make(chan int), "_user": "jane"},
+	}
+	if err := w.WriteMessage(m); err == nil {
+		t.Error("the marshalling error should be returned")
+	}
+
+	degraded, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if degraded.Short != "unserializable" || degraded.Host != "testing.local" || degraded.TimeUnix != 1500000000 || degraded.Level != 3 {
+		t.Errorf("expected the standard fields, got %+v", degraded)
+	}
+	if msg, _ := degraded.Extra["_marshal_error"].(string); !strings.Contains(msg, "chan") {
+		t.Errorf("expected the marshalling error in _marshal_error, got %v", degraded.Extra)
+	}
+	if _, ok := degraded.Extra["_user"]; ok {
+		t.Errorf("the additional fields should be dropped, got %v", degraded.Extra)
+	}
+	if m.Extra["_user"] != "jane" {
+		t.Error("the original message should be left untouched")
+	}
+}
+
+func TestIncludeStackHash(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.IncludeStackHash = true
+
+	var fingerprints []interface{}
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(w, "order %d failed", i)
+		fingerprints = append(fingerprints, ct.last().Extra["_fingerprint"])
+	}
+	fmt.Fprintf(w, "order %d failed", 3)
+	other := ct.last().Extra["_fingerprint"]
+
+	if s, _ := fingerprints[0].(string); len(s) != 16 {
+		t.Fatalf("expected a 16 characters fingerprint, got %v", fingerprints[0])
+	}
+	if fingerprints[1] != fingerprints[0] || fingerprints[2] != fingerprints[0] {
+		t.Errorf("the same call site should have a stable fingerprint, got %v", fingerprints)
+	}
+	if other == fingerprints[0] {
+		t.Errorf("another call site should have another fingerprint, got %v", other)
+	}
+
+	w.IncludeStackHash = false
+	w.Write([]byte("no fingerprint"))
+	if _, ok := ct.last().Extra["_fingerprint"]; ok {
+		t.Error("the fingerprint should be opt-in")
+	}
+}
+
+// closeCountingTransport records messages and counts its closes.
+type closeCountingTransport struct {
+	captureTransport
+	closes int
+}
+
+func (t *closeCountingTransport) Close() error {
+	t.closes++
+	return nil
+}
+
+func TestSendShutdownMarker(t *testing.T) {
+	w, _ := newCaptureWriter()
+	ct := &closeCountingTransport{}
+	w.Transport = ct
+	w.SendShutdownMarker = true
+
+	w.Write([]byte("last words"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+	w.Close()
+
+	markers := 0
+	for _, m := range ct.msgs {
+		if m.Extra["_shutdown"] == true {
+			markers++
+		}
+	}
+	if markers != 1 {
+		t.Errorf("expected the marker to be sent exactly once, got %d", markers)
+	}
+	if m := ct.last(); m.Extra["_shutdown"] != true || m.Level != 6 || m.Host != "testing.local" {
+		t.Errorf("expected an info marker as the last message, got %+v", m)
+	}
+	if ct.closes != 2 {
+		t.Errorf("expected the transport to be closed on every call, got %d", ct.closes)
+	}
+}
+
+func TestAddNumberAndString(t *testing.T) {
+	m := &Message{Version: "1.1", Short: "typed"}
+	m.AddNumber("took_ms", 42)
+	m.AddNumber("_ratio", 0.25)
+	m.AddNumber("invalid", math.NaN())
+	m.AddString("zip", "01234")
+	m.AddString("count", "7")
+
+	w, ct := newCaptureWriter()
+	for i := 0; i < 3; i++ {
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		b, err := json.Marshal(ct.last())
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		for _, field := range []string{`"_took_ms":42`, `"_ratio":0.25`, `"_zip":"01234"`, `"_count":"7"`} {
+			if !bytes.Contains(b, []byte(field)) {
+				t.Errorf("expected %s in %s", field, b)
+			}
+		}
+		if bytes.Contains(b, []byte("invalid")) {
+			t.Errorf("NaN should not be added, got %s", b)
+		}
+	}
+}
+
+func TestMaxFieldKeyLength(t *testing.T) {
+	if l := newWriter().MaxFieldKeyLength; l != DefaultMaxFieldKeyLength {
+		t.Errorf("expected the default key length, got %d", l)
+	}
+	w, ct := newCaptureWriter()
+	w.MaxFieldKeyLength = DefaultMaxFieldKeyLength
+	var errs []error
+	w.OnError = func(err error) { errs = append(errs, err) }
+
+	long := strings.Repeat("k", 300)
+	w.WriteMessage(&Message{Version: "1.1", Short: "long key", Extra: map[string]interface{}{
+		long:    "value",
+		"short": "kept",
+	}})
+
+	m := ct.last()
+	truncated := ("_" + long)[:DefaultMaxFieldKeyLength]
+	if m.Extra[truncated] != "value" || m.Extra["short"] != "kept" || len(m.Extra) != 2 {
+		t.Errorf("expected the long key truncated, got %v", m.Extra)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "truncated") {
+		t.Errorf("expected the truncation reported, got %v", errs)
+	}
+}
+
+func TestMaxDistinctFields(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.MaxDistinctFields = 3
+	var errs []error
+	w.OnError = func(err error) { errs = append(errs, err) }
+
+	w.WriteMessage(&Message{Version: "1.1", Short: "first", Extra: map[string]interface{}{"a": 1, "b": 2}})
+	w.WriteMessage(&Message{Version: "1.1", Short: "second", Extra: map[string]interface{}{"_a": 1, "c": 3}})
+	if m := ct.last(); len(m.Extra) != 2 || len(errs) != 0 {
+		t.Fatalf("keys up to the limit should be sent, got %v and %v", m.Extra, errs)
+	}
+
+	w.WriteMessage(&Message{Version: "1.1", Short: "third", Extra: map[string]interface{}{"b": 2, "d": 4, "e": 5}})
+	m := ct.last()
+	if m.Extra["b"] != 2 || m.Extra[AdditionalFieldPrefix+"dropped_fields"] != 2 || len(m.Extra) != 2 {
+		t.Errorf("expected the new keys dropped, got %v", m.Extra)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "2 fields dropped") {
+		t.Errorf("expected the dropped fields reported, got %v", errs)
+	}
+}
+
+func TestFacilitySource(t *testing.T) {
+	defer func(f func() (*debug.BuildInfo, bool)) { readBuildInfo = f }(readBuildInfo)
+
+	for _, tc := range []struct {
+		module   string
+		source   FacilitySource
+		facility string
+	}{
+		{"github.com/example/billing", FacilityFromModule, "billing"},
+		{"github.com/example/billing/v2", FacilityFromModule, "billing"},
+		{"command-line-arguments", FacilityFromModule, path.Base(os.Args[0])},
+		{"", FacilityFromModule, path.Base(os.Args[0])},
+		{"github.com/example/billing", FacilityFromArgs, path.Base(os.Args[0])},
+	} {
+		module := tc.module
+		readBuildInfo = func() (*debug.BuildInfo, bool) {
+			if module == "" {
+				return nil, false
+			}
+			return &debug.BuildInfo{Main: debug.Module{Path: module}}, true
+		}
+		w, ct := newCaptureWriter()
+		w.Facility = ""
+		w.FacilitySource = tc.source
+		w.Write([]byte("message"))
+		if f := ct.last().Facility; f != tc.facility {
+			t.Errorf("module %q, source %d: expected facility %q, got %q", tc.module, tc.source, tc.facility, f)
+		}
+	}
+
+	w, ct := newCaptureWriter()
+	w.Facility = "literal"
+	w.Write([]byte("message"))
+	if f := ct.last().Facility; f != "literal" {
+		t.Errorf("a set facility should be sent as is, got %q", f)
+	}
+}
+
+func TestShortFromLastLine(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.ShortFromLastLine = true
+
+	for _, tc := range []struct {
+		input, short, full string
+	}{
+		{"request failed\n  at handler.go:42\nerror: connection reset\n\n", "error: connection reset", "request failed\n  at handler.go:42\nerror: connection reset"},
+		{"header\n \t\nlast line  \n", "last line", "header\n \t\nlast line"},
+		{"single line", "single line", ""},
+	} {
+		w.Write([]byte(tc.input))
+		m := ct.last()
+		if m.Short != tc.short || m.Full != tc.full {
+			t.Errorf("%q: expected short %q and full %q, got %q and %q", tc.input, tc.short, tc.full, m.Short, m.Full)
+		}
+	}
+
+	w.ShortFromLastLine = false
+	w.Write([]byte("header\nerror"))
+	if m := ct.last(); m.Short != "header" {
+		t.Errorf("the first line should be the short message by default, got %q", m.Short)
+	}
+}
+
+func TestTruncationMarkers(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.MaxShortLength = 8
+	w.MaxFieldKeyLength = 24
+
+	long := strings.Repeat("k", 30)
+	w.WriteMessage(&Message{Version: "1.1", Short: "too long a message", Extra: map[string]interface{}{long: 1}})
+	m := ct.last()
+	if m.Short != "too long" || m.Full != "too long a message" {
+		t.Errorf("expected the short message truncated and kept as full, got %q and %q", m.Short, m.Full)
+	}
+	if _, ok := m.Extra[AdditionalFieldPrefix+"short_truncated_from"]; ok || len(m.Extra) != 1 {
+		t.Errorf("markers should be opt-in, got %v", m.Extra)
+	}
+
+	w.TruncationMarkers = true
+	w.WriteMessage(&Message{Version: "1.1", Short: "short", Extra: map[string]interface{}{"key": 1}})
+	if m := ct.last(); len(m.Extra) != 1 {
+		t.Errorf("expected no markers without truncation, got %v", m.Extra)
+	}
+
+	w.WriteMessage(&Message{Version: "1.1", Short: "é is two bytes", Full: "full", Extra: map[string]interface{}{long: 1, "_" + long + "xy": 2}})
+	m = ct.last()
+	if m.Short != "é is tw" || m.Full != "full" {
+		t.Errorf("expected the short message cut at a rune boundary, got %q and %q", m.Short, m.Full)
+	}
+	if from := m.Extra[AdditionalFieldPrefix+"short_truncated_from"]; from != len("é is two bytes") {
+		t.Errorf("expected the original short length, got %v", from)
+	}
+	if m.Extra[AdditionalFieldPrefix+"field_truncated"] != true {
+		t.Errorf("expected the field truncation marked, got %v", m.Extra)
+	}
+	if from := m.Extra[AdditionalFieldPrefix+"field_truncated_from"]; from != 33 {
+		t.Errorf("expected the longest original key length, got %v", from)
+	}
+}
+
+func TestMessageFieldPolicy(t *testing.T) {
+	defer func(p string) { AdditionalFieldPrefix = p }(AdditionalFieldPrefix)
+
+	for _, tc := range []struct {
+		policy     MessageFieldPolicy
+		prefix     string
+		extra      map[string]interface{}
+		short      string
+		full       string
+		serialized string
+	}{
+		{MessageFieldRename, "_", map[string]interface{}{"message": "field"}, "original", "", `"_message":"field"`},
+		{MessageFieldRename, "", map[string]interface{}{"message": "field", "_message": "taken"}, "original", "", `"__message":"field","_message":"taken"`},
+		{MessageFieldPromote, "_", map[string]interface{}{"message": "field", "user": "jane"}, "field", "original", `"_user":"jane"`},
+		{MessageFieldPromote, "", map[string]interface{}{"message": 42}, "42", "original", `"short_message":"42"`},
+	} {
+		AdditionalFieldPrefix = tc.prefix
+		w, ct := newCaptureWriter()
+		w.SortKeys = true
+		w.MessageFieldPolicy = tc.policy
+		if err := w.WriteMessage(&Message{Version: "1.1", Short: "original", Extra: tc.extra}); err != nil {
+			t.Fatalf("policy %d: WriteMessage: %s", tc.policy, err)
+		}
+
+		m := ct.last()
+		if m.Short != tc.short || m.Full != tc.full {
+			t.Errorf("policy %d: expected short %q and full %q, got %q and %q", tc.policy, tc.short, tc.full, m.Short, m.Full)
+		}
+		b, _ := json.Marshal(m)
+		if !bytes.Contains(b, []byte(tc.serialized)) || bytes.Contains(b, []byte(`"message":`)) {
+			t.Errorf("policy %d, prefix %q: expected %s and no message key in %s", tc.policy, tc.prefix, tc.serialized, b)
+		}
+	}
+}
+
+func TestFullMessageGzip(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.FullMessageGzipSize = 1024
+	w.CompressionLevel = flate.BestSpeed
+
+	full := "header\n" + strings.Repeat("a line of the stack trace\n", 100)
+	w.WriteMessage(&Message{Version: "1.1", Short: "header", Full: "small"})
+	if m := ct.last(); m.Full != "small" || len(m.Extra) != 0 {
+		t.Errorf("small full messages should be sent as is, got %q and %v", m.Full, m.Extra)
+	}
+
+	w.WriteMessage(&Message{Version: "1.1", Short: "header", Full: full})
+	m := ct.last()
+	if m.Full != full[:FullMessagePreview] {
+		t.Errorf("expected a preview as the full message, got %q", m.Full)
+	}
+	encoded, _ := m.Extra["_full_message_gz"].(string)
+	zBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("DecodeString: %s", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(zBytes))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %s", err)
+	}
+	decoded, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if string(decoded) != full {
+		t.Errorf("expected the full message back, got %q", decoded)
+	}
+	if len(encoded) >= len(full) {
+		t.Errorf("expected the encoded field smaller than the full message, got %d/%d bytes", len(encoded), len(full))
+	}
+}
+
+func TestRecover(t *testing.T) {
+	w, ct := newCaptureWriter()
+
+	func() {
+		defer w.Recover(false)
+		panic("boom")
+	}()
+	m := ct.last()
+	if m.Short != "panic: boom" || m.Level != 1 || m.Extra["_panic"] != true {
+		t.Errorf("expected the panic sent as an alert, got %+v", m)
+	}
+	if !strings.Contains(m.Full, "TestRecover") {
+		t.Errorf("expected the stack trace of the panic, got %q", m.Full)
+	}
+
+	var sent int
+	func() {
+		defer func() {
+			if r := recover(); r != "again" {
+				t.Errorf("expected the panic raised again, got %v", r)
+			}
+		}()
+		defer func() {
+			ct.mu.Lock()
+			sent = len(ct.msgs)
+			ct.mu.Unlock()
+		}()
+		defer w.Recover(true)
+		panic("again")
+	}()
+	if sent != 2 {
+		t.Errorf("expected the panic sent before it was raised again, got %d messages", sent)
+	}
+}
+
+func TestIncludeFieldCount(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.IncludeFieldCount = true
+	w.MaxDistinctFields = 4
+	w.Environment = "staging"
+	derived := w.WithFields(map[string]interface{}{"subsystem": "billing"})
+
+	for _, extra := range []map[string]interface{}{
+		nil,
+		{"user": "jane"},
+		{"user": "john", "a": 1, "b": 2, "c": 3},
+	} {
+		derived.WriteMessage(&Message{Version: "1.1", Short: "counted", Extra: extra})
+		b, _ := json.Marshal(ct.last())
+		var wire map[string]interface{}
+		json.Unmarshal(b, &wire)
+		fields := 0
+		for k := range wire {
+			if strings.HasPrefix(k, "_") {
+				fields++
+			}
+		}
+		if wire["_field_count"] != float64(fields) {
+			t.Errorf("expected _field_count %d, got %v in %s", fields, wire["_field_count"], b)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.Filter = func(m *Message) bool {
+		return m.Extra["_path"] != "/healthz"
+	}
+	derived := w.WithFields(map[string]interface{}{"path": "/healthz"})
+	if _, err := derived.Write([]byte("GET /healthz")); err != nil {
+		t.Errorf("filtered messages should not be an error, got %s", err)
+	}
+	w.WriteMessage(&Message{Version: "1.1", Short: "GET /orders", Extra: map[string]interface{}{"_path": "/orders"}})
+	w.WriteMessage(&Message{Version: "1.1", Short: "GET /healthz", Extra: map[string]interface{}{"_path": "/healthz"}})
+
+	if len(ct.msgs) != 1 || ct.last().Short != "GET /orders" {
+		t.Errorf("expected only the other path sent, got %d messages", len(ct.msgs))
+	}
+	if n := derived.Filtered(); n != 2 {
+		t.Errorf("expected 2 filtered messages, got %d", n)
+	}
+}
+
+func TestDebugToStderr(t *testing.T) {
+	defer func(w io.Writer, d time.Duration) { stderr, DebugErrorInterval = w, d }(stderr, DebugErrorInterval)
+	var buf bytes.Buffer
+	stderr = &buf
+	DebugErrorInterval = 50 * time.Millisecond
+
+	w, _ := newCaptureWriter()
+	ft := &flakyTransport{down: true}
+	w.Transport = ft
+	w.Write([]byte("quiet"))
+	if buf.Len() != 0 {
+		t.Fatalf("errors should only be printed with DebugToStderr, got %q", buf.String())
+	}
+
+	w.DebugToStderr = true
+	for i := 0; i < 5; i++ {
+		w.Write([]byte("lost"))
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 1 || lines[0] != `gelf: sending "lost" failed: network unreachable` {
+		t.Fatalf("expected a single error printed, got %q", buf.String())
+	}
+
+	time.Sleep(DebugErrorInterval)
+	w.Write([]byte("later"))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[1] != `gelf: sending "later" failed: network unreachable (4 more errors suppressed)` {
+		t.Errorf("expected the suppressed errors counted, got %q", buf.String())
+	}
+}
+
+func TestFieldPrefix(t *testing.T) {
+	w, ct := newCaptureWriter()
+	w.Environment = "staging"
+	db := w.WithFields(map[string]interface{}{"conn": "primary"})
+	db.FieldPrefix = "db_"
+
+	db.WriteMessage(&Message{Version: "1.1", Short: "query", Extra: map[string]interface{}{"query": "SELECT 1", "_rows": 3, "_db_table": "orders"}})
+	expected := map[string]interface{}{"_db_conn": "primary", "_db_query": "SELECT 1", "_db_rows": 3, "_db_table": "orders", "_environment": "staging"}
+	if m := ct.last(); fmt.Sprint(m.Extra) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, m.Extra)
+	}
+
+	db.WithFields(map[string]interface{}{"table": "users"}).WriteMessage(&Message{Version: "1.1", Short: "derived"})
+	expected = map[string]interface{}{"_db_conn": "primary", "_db_table": "users", "_environment": "staging"}
+	if m := ct.last(); fmt.Sprint(m.Extra) != fmt.Sprint(expected) {
+		t.Errorf("expected the prefix inherited, got %v", m.Extra)
+	}
+
+	w.WriteMessage(&Message{Version: "1.1", Short: "root", Extra: map[string]interface{}{"query": "SELECT 2"}})
+	if m := ct.last(); m.Extra["query"] != "SELECT 2" {
+		t.Errorf("the prefix should only apply to the subsystem, got %v", m.Extra)
+	}
+}
+
+func TestWouldChunk(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.CompressionType = NoCompress
+	w.MaxChunkSize = 1024
+
+	m := &Message{Version: "1.1", Host: "testing.local"}
+	b, _ := w.Encode(m)
+	fits := w.MaxChunkSize - len(b)
+
+	for _, tc := range []struct {
+		short  int
+		chunk  bool
+		chunks int
+	}{
+		{fits, false, 1},
+		{fits + 1, true, 2},
+		{fits + 1500, true, 3},
+	} {
+		m.Short = strings.Repeat("x", tc.short)
+		chunk, chunks, err := w.WouldChunk(m)
+		if err != nil {
+			t.Fatalf("WouldChunk: %s", err)
+		}
+		if chunk != tc.chunk || chunks != tc.chunks {
+			t.Errorf("%d bytes: expected %v and %d chunks, got %v and %d", tc.short, tc.chunk, tc.chunks, chunk, chunks)
+		}
+	}
+
+	if _, _, err := w.WouldChunk(&Message{Extra: map[string]interface{}{"bad": math.NaN()}}); err == nil {
+		t.Errorf("expected the encoding error")
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
+	"os/signal"
+	"path"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,11 +21,25 @@ import (
 
 const StackTraceKey = "_stacktrace"
 
+// TimestampKey is the logrus field overriding the timestamp of a message,
+// as a time.Time or as seconds since the UNIX epoch.  The entry time is
+// used if the field holds anything else.
+const TimestampKey = "timestamp"
+
+// MessageTemplateKey is the logrus field carrying the unrendered format
+// string of a printf-style message, like "user %d failed", which is sent
+// as the _message_template field so that Graylog can group the messages
+// whatever their arguments.  It isn't subject to AllowlistFields.
+const MessageTemplateKey = "message_template"
+
 // Set graylog.BufSize = <value> _before_ calling NewGraylogHook
 // Once the buffer is full, logging will start blocking, waiting for slots to
 // be available in the queue.
 var BufSize uint = 8192
 
+// FlushTimeout bounds how long FlushOnSignal waits for the queue to drain.
+var FlushTimeout = 5 * time.Second
+
 // GraylogHook to send logs to a logging service compatible with the Graylog API and the GELF format.
 type GraylogHook struct {
 	Extra       map[string]interface{}
@@ -28,22 +47,37 @@ type GraylogHook struct {
 	Level       logrus.Level
 	gelfLogger  *Writer
 	buf         chan graylogEntry
+	urgent      chan graylogEntry
 	wg          sync.WaitGroup
 	mu          sync.RWMutex
 	synchronous bool
 	blacklist   map[string]bool
+	allowlist   []string
+	promote     map[string]string
+	loggerName  string
+
+	hwMu        sync.Mutex // guards the high-water fields, never held while sending
+	highWater   int
+	onHighWater func()
+	aboveHigh   bool
+
+	priority    bool
+	urgentLevel logrus.Level
+	dropped     uint64 // guarded by hwMu
 }
 
 // Graylog needs file and line params
 type graylogEntry struct {
 	*logrus.Entry
-	file string
-	line int
+	file        string
+	line        int
+	function    string
+	fingerprint string
 }
 
 // NewGraylogHook creates a hook to be added to an instance of logger.
 // The addr parameter can include a schema,
-// which must be "http", "https", or "udp" (like http://graylog.example.com/gelf),
+// which must be "http", "https", "tcp" or "udp" (like http://graylog.example.com/gelf),
 // or can be a simple hostname (like 127.0.0.1:12201). If there is no schema
 // the writer will use UDP.
 func NewGraylogHook(addr string, extra map[string]interface{}) *GraylogHook {
@@ -71,7 +105,7 @@ func NewGraylogHook(addr string, extra map[string]interface{}) *GraylogHook {
 // The hook created will be asynchronous, and it's the responsibility of the user to call the Flush method
 // before exiting to empty the log queue.
 // The addr parameter can include a schema,
-// which must be "http", "https", or "udp" (like http://graylog.example.com/gelf),
+// which must be "http", "https", "tcp" or "udp" (like http://graylog.example.com/gelf),
 // or can be a simple hostname (like 127.0.0.1:12201). If there is no schema
 // the writer will use UDP.
 func NewAsyncGraylogHook(addr string, extra map[string]interface{}) *GraylogHook {
@@ -91,6 +125,7 @@ func NewAsyncGraylogHook(addr string, extra map[string]interface{}) *GraylogHook
 		Level:      logrus.DebugLevel,
 		gelfLogger: g,
 		buf:        make(chan graylogEntry, BufSize),
+		urgent:     make(chan graylogEntry, BufSize),
 	}
 	go hook.fire() // Log in background
 	return hook
@@ -105,7 +140,11 @@ func (hook *GraylogHook) Fire(entry *logrus.Entry) error {
 
 	// get caller file and line here, it won't be available inside the goroutine
 	// 1 for the function that called us.
-	file, line := getCallerIgnoringLogMulti(1)
+	file, line, function := getCallerIgnoringLogMulti(1)
+	var fingerprint string
+	if w := hook.gelfLogger; w != nil && w.IncludeStackHash {
+		fingerprint = stackFingerprint(1, w.StackHashFrames)
+	}
 
 	newData := make(map[string]interface{})
 	for k, v := range entry.Data {
@@ -119,18 +158,109 @@ func (hook *GraylogHook) Fire(entry *logrus.Entry) error {
 		Level:   entry.Level,
 		Message: entry.Message,
 	}
-	gEntry := graylogEntry{newEntry, file, line}
+	gEntry := graylogEntry{newEntry, file, line, function, fingerprint}
 
 	if hook.synchronous {
 		hook.sendEntry(gEntry)
 	} else {
-		hook.wg.Add(1)
-		hook.buf <- gEntry
+		hook.enqueue(gEntry)
+		hook.checkHighWater()
 	}
 
 	return nil
 }
 
+// enqueue queues an entry for the background sender, in the urgent lane
+// if PriorityQueue says so.  Other entries are dropped rather than block
+// when their lane is full, with PriorityQueue.
+func (hook *GraylogHook) enqueue(entry graylogEntry) {
+	hook.wg.Add(1)
+	if !hook.priority {
+		hook.buf <- entry
+		return
+	}
+	if entry.Level <= hook.urgentLevel {
+		hook.urgent <- entry
+		return
+	}
+
+	select {
+	case hook.buf <- entry:
+	default:
+		hook.wg.Done()
+		hook.hwMu.Lock()
+		hook.dropped++
+		hook.hwMu.Unlock()
+	}
+}
+
+// PriorityQueue makes an asynchronous hook queue the entries at level or
+// above, like logrus.ErrorLevel, in a lane of their own which is drained
+// first and never drops entries.  The other entries are dropped when
+// their lane is full, rather than block logging, and counted by Dropped.
+func (hook *GraylogHook) PriorityQueue(level logrus.Level) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	hook.priority = true
+	hook.urgentLevel = level
+}
+
+// Dropped returns the number of entries dropped because their queue was
+// full, see PriorityQueue.
+func (hook *GraylogHook) Dropped() uint64 {
+	hook.hwMu.Lock()
+	defer hook.hwMu.Unlock()
+	return hook.dropped
+}
+
+// QueueLen returns the number of entries waiting to be sent by an
+// asynchronous hook.
+func (hook *GraylogHook) QueueLen() int {
+	return len(hook.buf) + len(hook.urgent)
+}
+
+// QueueCap returns the capacity of the queue of an asynchronous hook,
+// set by BufSize.  Logging blocks once QueueLen reaches it, unless the
+// entries are prioritized, in which case each lane has this capacity.
+func (hook *GraylogHook) QueueCap() int {
+	return cap(hook.buf)
+}
+
+// OnQueueHighWater registers a callback invoked when the queue of an
+// asynchronous hook reaches threshold entries.  It is invoked once per
+// crossing: the queue has to drain below the threshold before it can
+// fire again.  The callback runs on the logging goroutine and must not
+// log through the hook.
+func (hook *GraylogHook) OnQueueHighWater(threshold int, cb func()) {
+	hook.hwMu.Lock()
+	defer hook.hwMu.Unlock()
+	hook.highWater = threshold
+	hook.onHighWater = cb
+	hook.aboveHigh = false
+}
+
+// checkHighWater invokes the high-water callback if the queue just
+// reached the threshold, and rearms it once the queue drained below.
+func (hook *GraylogHook) checkHighWater() {
+	hook.hwMu.Lock()
+	if hook.onHighWater == nil {
+		hook.hwMu.Unlock()
+		return
+	}
+	var cb func()
+	if hook.QueueLen() < hook.highWater {
+		hook.aboveHigh = false
+	} else if !hook.aboveHigh {
+		hook.aboveHigh = true
+		cb = hook.onHighWater
+	}
+	hook.hwMu.Unlock()
+
+	if cb != nil {
+		cb()
+	}
+}
+
 // Flush waits for the log queue to be empty.
 // This func is meant to be used when the hook was created with NewAsyncGraylogHook.
 func (hook *GraylogHook) Flush() {
@@ -140,10 +270,64 @@ func (hook *GraylogHook) Flush() {
 	hook.wg.Wait()
 }
 
-// fire will loop on the 'buf' channel, and write entries to graylog
+// FlushOnSignal flushes the hook when the process receives one of the
+// given signals, os.Interrupt and SIGTERM by default, waiting FlushTimeout
+// at most.  The signal is then raised again with the handler removed, so
+// that the process terminates as it would have without it.
+//
+// Applications which handle these signals themselves will receive them
+// twice, and should rather call Flush from their own handler.
+func (hook *GraylogHook) FlushOnSignal(sig ...os.Signal) {
+	flushOnSignal(sig, func() { hook.flushTimeout(FlushTimeout) })
+}
+
+// flushOnSignal calls flush when one of the signals is received, then
+// raises the signal again with the handler removed.
+func flushOnSignal(sig []os.Signal, flush func()) {
+	if len(sig) == 0 {
+		sig = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+	go func() {
+		s := <-c
+		flush()
+		signal.Stop(c)
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(s)
+		}
+	}()
+}
+
+// flushTimeout flushes the hook, giving up after the timeout.
+func (hook *GraylogHook) flushTimeout(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		hook.Flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// fire will loop on the 'buf' channel, and write entries to graylog.
+// Entries of the urgent lane are sent first.
 func (hook *GraylogHook) fire() {
 	for {
-		entry := <-hook.buf // receive new entry on channel
+		var entry graylogEntry
+		select {
+		case entry = <-hook.urgent:
+		default:
+			select {
+			case entry = <-hook.urgent:
+			case entry = <-hook.buf: // receive new entry on channel
+			}
+		}
+		hook.checkHighWater()
 		hook.sendEntry(entry)
 		hook.wg.Done()
 	}
@@ -173,16 +357,39 @@ func (hook *GraylogHook) sendEntry(entry graylogEntry) {
 
 	level := int32(entry.Level) + 2 // logrus levels are lower than syslog by 2
 
+	t := entry.Time
+	if t.IsZero() {
+		// manually built entries have no time, which Graylog rejects
+		t = time.Now()
+	}
+	timestamp := float64(t.UnixNano()/1000000) / 1000.
+
 	// Don't modify entry.Data directly, as the entry will used after this hook was fired
 	extra := map[string]interface{}{}
 	// Merge extra fields
 	for k, v := range hook.Extra {
-		k = fmt.Sprintf("_%s", k) // "[...] every field you send and prefix with a _ (underscore) will be treated as an additional field."
+		k = AdditionalFieldPrefix + k // "[...] every field you send and prefix with a _ (underscore) will be treated as an additional field."
 		extra[k] = v
 	}
+	if hook.loggerName != "" {
+		extra[AdditionalFieldPrefix+"logger"] = hook.loggerName
+	}
+	if entry.fingerprint != "" {
+		extra[AdditionalFieldPrefix+"fingerprint"] = entry.fingerprint
+	}
 	for k, v := range entry.Data {
-		if !hook.blacklist[k] {
-			extraK := fmt.Sprintf("_%s", k) // "[...] every field you send and prefix with a _ (underscore) will be treated as an additional field."
+		if k == TimestampKey {
+			if ts, ok := fieldTimestamp(v); ok {
+				timestamp = ts
+				continue
+			}
+		}
+		if k == MessageTemplateKey && !hook.blacklist[k] {
+			extra[AdditionalFieldPrefix+MessageTemplateKey] = fmt.Sprint(v)
+			continue
+		}
+		if hook.keep(k) {
+			extraK := AdditionalFieldPrefix + k // "[...] every field you send and prefix with a _ (underscore) will be treated as an additional field."
 			if k == logrus.ErrorKey {
 				asError, isError := v.(error)
 				_, isMarshaler := v.(json.Marshaler)
@@ -193,10 +400,11 @@ func (hook *GraylogHook) sendEntry(entry graylogEntry) {
 				}
 				if stackTrace := extractStackTrace(asError); stackTrace != nil {
 					extra[StackTraceKey] = fmt.Sprintf("%+v", stackTrace)
-					file, line := extractFileAndLine(stackTrace)
+					file, line, function := extractCaller(stackTrace)
 					if file != "" && line != 0 {
 						entry.file = file
 						entry.line = line
+						entry.function = function
 					}
 				}
 			} else {
@@ -210,18 +418,38 @@ func (hook *GraylogHook) sendEntry(entry graylogEntry) {
 		Host:     hook.Host,
 		Short:    string(short),
 		Full:     string(full),
-		TimeUnix: float64(time.Now().UnixNano()/1000000) / 1000.,
+		TimeUnix: timestamp,
 		Level:    level,
 		File:     entry.file,
 		Line:     entry.line,
 		Extra:    extra,
 	}
+	for k, field := range hook.promote {
+		if v, ok := entry.Data[k]; ok && hook.keep(k) && setTopLevel(&m, field, v) {
+			delete(m.Extra, AdditionalFieldPrefix+k)
+		}
+	}
+	if w.IncludeFunc {
+		setFuncFields(&m, entry.function)
+	}
 
 	if err := w.WriteMessage(&m); err != nil {
 		fmt.Println(err)
 	}
 }
 
+// fieldTimestamp converts the value of the TimestampKey field to a GELF
+// timestamp, reporting whether it has a valid type.
+func fieldTimestamp(v interface{}) (float64, bool) {
+	switch ts := v.(type) {
+	case time.Time:
+		return float64(ts.UnixNano()/1000000) / 1000., true
+	case float64:
+		return ts, true
+	}
+	return 0, false
+}
+
 // Levels returns the available logging levels.
 func (hook *GraylogHook) Levels() []logrus.Level {
 	levels := []logrus.Level{}
@@ -243,6 +471,92 @@ func (hook *GraylogHook) Blacklist(b []string) {
 	}
 }
 
+// AllowlistFields restricts the fields sent to those whose key matches
+// one of the patterns, in the syntax of path.Match, like "http_*".  This
+// keeps fields added elsewhere in the codebase from leaking.  Allowed
+// fields are still filtered by Blacklist.
+func (hook *GraylogHook) AllowlistFields(patterns []string) {
+	hook.allowlist = patterns
+}
+
+// keep reports whether the field k should be sent, according to
+// AllowlistFields and then Blacklist.
+func (hook *GraylogHook) keep(k string) bool {
+	if hook.allowlist != nil {
+		allowed := false
+		for _, pattern := range hook.allowlist {
+			if ok, _ := path.Match(pattern, k); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return !hook.blacklist[k]
+}
+
+// WithLoggerName sets the name sent as the _logger field of every message,
+// to tell apart the loggers sharing a Graylog stream, and returns the hook.
+func (hook *GraylogHook) WithLoggerName(name string) *GraylogHook {
+	hook.loggerName = name
+	return hook
+}
+
+// PromoteFields maps logrus fields to GELF top-level fields, like
+// {"hostname": "host"}.  The supported top-level fields are host,
+// short_message, full_message, facility and file, which take strings,
+// and line, which takes an integer.  A promoted field is removed from
+// the additional fields, unless its value has the wrong type.
+func (hook *GraylogHook) PromoteFields(fields map[string]string) {
+	hook.promote = make(map[string]string, len(fields))
+	for k, field := range fields {
+		hook.promote[k] = field
+	}
+}
+
+// setTopLevel sets a top-level field of a message, reporting whether
+// the field is supported and the value has the right type.
+func setTopLevel(m *Message, field string, v interface{}) bool {
+	if field == "line" {
+		switch line := v.(type) {
+		case int:
+			m.Line = line
+		case int64:
+			m.Line = int(line)
+		case float64:
+			if line != float64(int(line)) {
+				return false
+			}
+			m.Line = int(line)
+		default:
+			return false
+		}
+		return true
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	switch field {
+	case "host":
+		m.Host = s
+	case "short_message":
+		m.Short = s
+	case "full_message":
+		m.Full = s
+	case "facility":
+		m.Facility = s
+	case "file":
+		m.File = s
+	default:
+		return false
+	}
+	return true
+}
+
 // SetWriter sets the hook Gelf Writer
 func (hook *GraylogHook) SetWriter(w *Writer) error {
 	if w == nil {
@@ -257,19 +571,20 @@ func (hook *GraylogHook) Writer() *Writer {
 	return hook.gelfLogger
 }
 
-// getCaller returns the filename and the line info of a function
-// further down in the call stack.  Passing 0 in as callDepth would
-// return info on the function calling getCallerIgnoringLog, 1 the
-// parent function, and so on.  Any suffixes passed to getCaller are
-// path fragments like "/pkg/log/log.go", and functions in the call
-// stack from that file are ignored.
-func getCaller(callDepth int, suffixesToIgnore ...string) (file string, line int) {
+// getCaller returns the filename, the line info and the function name
+// of a function further down in the call stack.  Passing 0 in as
+// callDepth would return info on the function calling
+// getCallerIgnoringLog, 1 the parent function, and so on.  Any suffixes
+// passed to getCaller are path fragments like "/pkg/log/log.go", and
+// functions in the call stack from that file are ignored.
+func getCaller(callDepth int, suffixesToIgnore ...string) (file string, line int, function string) {
 	// bump by 1 to ignore the getCaller (this) stackframe
 	callDepth++
 outer:
 	for {
 		var ok bool
-		_, file, line, ok = runtime.Caller(callDepth)
+		var pc uintptr
+		pc, file, line, ok = runtime.Caller(callDepth)
 		if !ok {
 			file = "???"
 			line = 0
@@ -282,12 +597,66 @@ outer:
 				continue outer
 			}
 		}
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			function = fn.Name()
+		}
 		break
 	}
 	return
 }
 
-func getCallerIgnoringLogMulti(callDepth int) (string, int) {
+// logrusFiles are the files of the frames between the caller and the hook.
+var logrusFiles = []string{"logrus/hooks.go", "logrus/entry.go", "logrus/logger.go", "logrus/exported.go", "asm_amd64.s"}
+
+func getCallerIgnoringLogMulti(callDepth int) (string, int, string) {
 	// the +1 is to ignore this (getCallerIgnoringLogMulti) frame
-	return getCaller(callDepth+1, "logrus/hooks.go", "logrus/entry.go", "logrus/logger.go", "logrus/exported.go", "asm_amd64.s")
+	return getCaller(callDepth+1, logrusFiles...)
+}
+
+// stackFingerprint returns a short hash of the functions and lines of the
+// given number of frames of the caller, 3 by default, skipping logrus.
+func stackFingerprint(callDepth int, frames int) string {
+	if frames <= 0 {
+		frames = 3
+	}
+	// bump by 1 to ignore the stackFingerprint (this) stackframe
+	callDepth++
+
+	h := fnv.New64a()
+outer:
+	for n := 0; n < frames; callDepth++ {
+		pc, file, line, ok := runtime.Caller(callDepth)
+		if !ok {
+			break
+		}
+		for _, s := range logrusFiles {
+			if strings.HasSuffix(file, s) {
+				continue outer
+			}
+		}
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			io.WriteString(h, fn.Name())
+		}
+		fmt.Fprintf(h, ":%d\n", line)
+		n++
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// setFuncFields adds the _func and _package fields for a function name
+// as reported by the runtime, like "github.com/sirupsen/logrus.(*Entry).Info".
+func setFuncFields(m *Message, function string) {
+	if function == "" {
+		return
+	}
+	pkg, fn := "", function
+	slash := strings.LastIndex(function, "/")
+	if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+		dot += slash + 1
+		pkg, fn = function[:dot], function[dot+1:]
+	}
+	m.setExtra(AdditionalFieldPrefix+"func", fn)
+	if pkg != "" {
+		m.setExtra(AdditionalFieldPrefix+"package", pkg)
+	}
 }
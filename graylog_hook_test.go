@@ -102,7 +102,7 @@ func TestWritingToHTTP(t *testing.T) {
 		if handlerErr != nil {
 			t.Fatalf("Couldn't decode message: %s", handlerErr)
 		}
-		w.Write([]byte("ok"))
+		w.WriteHeader(http.StatusAccepted)
 		close(msgRead)
 	})
 
@@ -393,3 +393,333 @@ runtime.*
 		t.Errorf("Stack Trace not as expected. Got:\n%s\n", stacktrace)
 	}
 }
+
+// blockingTransport holds every message until it is released.
+type blockingTransport struct {
+	release chan struct{}
+}
+
+func (t *blockingTransport) WriteMessage(m *Message) error {
+	<-t.release
+	return nil
+}
+
+func TestQueueHighWater(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	bt := &blockingTransport{release: make(chan struct{})}
+	hook.SetWriter(&Writer{Transport: bt})
+
+	calls := 0
+	hook.OnQueueHighWater(5, func() { calls++ })
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook)
+	for i := 0; i < 10; i++ {
+		log.Info("Logging")
+	}
+
+	if hook.QueueCap() != int(BufSize) {
+		t.Errorf("QueueCap should match BufSize (exp: %d, got %d)", BufSize, hook.QueueCap())
+	}
+	if l := hook.QueueLen(); l < 5 {
+		t.Errorf("QueueLen should be past the high-water mark, got %d", l)
+	}
+	if calls != 1 {
+		t.Errorf("high-water callback should fire once, got %d calls", calls)
+	}
+
+	close(bt.release)
+	hook.Flush()
+	if l := hook.QueueLen(); l != 0 {
+		t.Errorf("QueueLen should be 0 after Flush, got %d", l)
+	}
+}
+
+func newCaptureHook(t *testing.T) (*GraylogHook, *captureTransport) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook := NewGraylogHook(r.Addr(), nil)
+	w, ct := newCaptureWriter()
+	hook.SetWriter(w)
+	return hook, ct
+}
+
+func TestTimestampField(t *testing.T) {
+	historical := time.Date(2017, 6, 1, 12, 30, 0, 500000000, time.UTC)
+	tests := []struct {
+		value     interface{}
+		timestamp float64
+		extra     bool
+	}{
+		{historical, 1496320200.5, false},
+		{1496320200.25, 1496320200.25, false},
+		{"yesterday", 0, true},
+	}
+
+	for _, tt := range tests {
+		hook, ct := newCaptureHook(t)
+		log := logrus.New()
+		log.Out = ioutil.Discard
+		log.Hooks.Add(hook)
+
+		before := time.Now()
+		log.WithField(TimestampKey, tt.value).Info("replayed event")
+
+		msg := ct.last()
+		if tt.timestamp != 0 && msg.TimeUnix != tt.timestamp {
+			t.Errorf("%#v: expected timestamp %f, got %f", tt.value, tt.timestamp, msg.TimeUnix)
+		}
+		if tt.timestamp == 0 && msg.TimeUnix < float64(before.Unix()) {
+			t.Errorf("%#v: expected the entry time, got %f", tt.value, msg.TimeUnix)
+		}
+		if _, ok := msg.Extra["_"+TimestampKey]; ok != tt.extra {
+			t.Errorf("%#v: timestamp extra field present = %v", tt.value, ok)
+		}
+	}
+}
+
+func TestIncludeFunc(t *testing.T) {
+	hook, ct := newCaptureHook(t)
+	hook.Writer().IncludeFunc = true
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook)
+	log.Info("message")
+
+	msg := ct.last()
+	if fn := msg.Extra["_func"]; fn != "TestIncludeFunc" {
+		t.Errorf("_func should be the calling function (exp: TestIncludeFunc, got: %v)", fn)
+	}
+	if pkg, _ := msg.Extra["_package"].(string); !strings.HasSuffix(pkg, "logrus-graylog-hook") {
+		t.Errorf("_package should be the calling package, got %v", pkg)
+	}
+
+	w, ct := newCaptureWriter()
+	w.IncludeFunc = true
+	w.Write([]byte("message"))
+	if fn := ct.last().Extra["_func"]; fn != "TestIncludeFunc" {
+		t.Errorf("_func should be the function calling Write (exp: TestIncludeFunc, got: %v)", fn)
+	}
+}
+
+func TestPromoteFields(t *testing.T) {
+	hook, ct := newCaptureHook(t)
+	hook.PromoteFields(map[string]string{"hostname": "host", "src_line": "line"})
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook)
+	log.WithFields(logrus.Fields{"hostname": "web-1", "src_line": 42, "other": "1"}).Info("message")
+
+	msg := ct.last()
+	if msg.Host != "web-1" {
+		t.Errorf("Host should be promoted (exp: web-1, got: %s)", msg.Host)
+	}
+	if msg.Line != 42 {
+		t.Errorf("Line should be promoted (exp: 42, got: %d)", msg.Line)
+	}
+	if _, ok := msg.Extra["_hostname"]; ok {
+		t.Error("promoted field should be removed from the extra fields")
+	}
+	if msg.Extra["_other"] != "1" {
+		t.Errorf("other fields should be kept, got %v", msg.Extra)
+	}
+
+	log.WithField("hostname", 12).Info("message")
+	msg = ct.last()
+	if msg.Host != hook.Host {
+		t.Errorf("Host should not be promoted from an integer, got %s", msg.Host)
+	}
+	if msg.Extra["_hostname"] != 12 {
+		t.Errorf("field with an invalid type should be kept as an extra field, got %v", msg.Extra)
+	}
+}
+
+func TestWithLoggerName(t *testing.T) {
+	hook, ct := newCaptureHook(t)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook.WithLoggerName("api"))
+	log.Info("message")
+
+	if name := ct.last().Extra["_logger"]; name != "api" {
+		t.Errorf("_logger should match (exp: api, got: %v)", name)
+	}
+}
+
+// gatedTransport records the messages it sends, each one waiting for
+// the gate to open.
+type gatedTransport struct {
+	captureTransport
+	gate chan struct{}
+}
+
+func (t *gatedTransport) WriteMessage(m *Message) error {
+	<-t.gate
+	return t.captureTransport.WriteMessage(m)
+}
+
+func TestPriorityQueue(t *testing.T) {
+	BufSize = 4
+	defer func() { BufSize = 8192 }()
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	gt := &gatedTransport{gate: make(chan struct{})}
+	hook.SetWriter(&Writer{Transport: gt})
+	hook.PriorityQueue(logrus.ErrorLevel)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Level = logrus.DebugLevel
+	log.Hooks.Add(hook)
+
+	log.Debug("in flight")
+	for hook.QueueLen() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		log.Debug("flood")
+	}
+	for i := 0; i < 3; i++ {
+		log.Error("failure")
+	}
+
+	if dropped := hook.Dropped(); dropped != 16 {
+		t.Errorf("expected the debug entries above the queue capacity to be dropped, got %d", dropped)
+	}
+	close(gt.gate)
+	hook.Flush()
+
+	gt.mu.Lock()
+	defer gt.mu.Unlock()
+	var shorts []string
+	for _, m := range gt.msgs {
+		shorts = append(shorts, m.Short)
+	}
+	expected := []string{"in flight", "failure", "failure", "failure", "flood", "flood", "flood", "flood"}
+	if fmt.Sprint(shorts) != fmt.Sprint(expected) {
+		t.Errorf("expected errors to survive and be sent first, got %v", shorts)
+	}
+}
+
+func TestZeroEntryTime(t *testing.T) {
+	hook, ct := newCaptureHook(t)
+
+	entry := &logrus.Entry{Logger: logrus.New(), Data: logrus.Fields{}, Level: logrus.InfoLevel, Message: "no time"}
+	if err := hook.Fire(entry); err != nil {
+		t.Fatalf("Fire: %s", err)
+	}
+
+	now := float64(time.Now().UnixNano()) / 1e9
+	if ts := ct.last().TimeUnix; ts < now-5 || ts > now+1 {
+		t.Errorf("expected a current timestamp for a zero entry time, got %f (now %f)", ts, now)
+	}
+}
+
+func TestAllowlistFields(t *testing.T) {
+	for _, tc := range []struct {
+		blacklist []string
+		expected  []string
+	}{
+		{nil, []string{"_http_method", "_http_status", "_request_id"}},
+		{[]string{"http_status", "user"}, []string{"_http_method", "_request_id"}},
+	} {
+		hook, ct := newCaptureHook(t)
+		hook.AllowlistFields([]string{"http_*", "request_id"})
+		hook.Blacklist(tc.blacklist)
+
+		log := logrus.New()
+		log.Out = ioutil.Discard
+		log.Hooks.Add(hook)
+		log.WithFields(logrus.Fields{
+			"http_method": "GET",
+			"http_status": 200,
+			"request_id":  "r-1",
+			"user":        "jane",
+			"password":    "secret",
+		}).Info("allow-listed")
+
+		extra := ct.last().Extra
+		if len(extra) != len(tc.expected) {
+			t.Errorf("blacklist %v: expected %v, got %v", tc.blacklist, tc.expected, extra)
+		}
+		for _, k := range tc.expected {
+			if _, ok := extra[k]; !ok {
+				t.Errorf("blacklist %v: %s should be sent, got %v", tc.blacklist, k, extra)
+			}
+		}
+	}
+}
+
+func TestMessageTemplate(t *testing.T) {
+	hook, ct := newCaptureHook(t)
+	hook.AllowlistFields([]string{"user"})
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook)
+	format := "user %d failed to log in"
+	log.WithField(MessageTemplateKey, format).Warnf(format, 42)
+
+	m := ct.last()
+	if m.Short != "user 42 failed to log in" {
+		t.Errorf("expected the rendered short message, got %q", m.Short)
+	}
+	if m.Extra["_message_template"] != format {
+		t.Errorf("expected the template in _message_template, got %v", m.Extra)
+	}
+	if len(m.Extra) != 1 {
+		t.Errorf("the template should bypass the allow-list and be the only field, got %v", m.Extra)
+	}
+}
+
+func TestMessageTemplatePrefix(t *testing.T) {
+	defer func(p string) { AdditionalFieldPrefix = p }(AdditionalFieldPrefix)
+	AdditionalFieldPrefix = "@"
+	hook, ct := newCaptureHook(t)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook)
+	log.WithField(MessageTemplateKey, "user %d").Warnf("user %d", 42)
+
+	if m := ct.last(); m.Extra["@message_template"] != "user %d" {
+		t.Errorf("expected the template under the custom prefix, got %v", m.Extra)
+	}
+}
+
+func TestHookStackHash(t *testing.T) {
+	hook, ct := newCaptureHook(t)
+	hook.Writer().IncludeStackHash = true
+	hook.Writer().StackHashFrames = 1
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook)
+
+	var fingerprints []interface{}
+	for i := 0; i < 2; i++ {
+		log.WithField("id", i).Error("failed")
+		fingerprints = append(fingerprints, ct.last().Extra["_fingerprint"])
+	}
+	log.Error("failed")
+	if fingerprints[0] == nil || fingerprints[0] != fingerprints[1] {
+		t.Errorf("the same call site should have a stable fingerprint, got %v", fingerprints)
+	}
+	if ct.last().Extra["_fingerprint"] == fingerprints[0] {
+		t.Error("another call site should have another fingerprint")
+	}
+}
@@ -0,0 +1,42 @@
+package graylog
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TrustForwardedFor makes HTTPFields report the client address of the
+// X-Forwarded-For header as _http_remote, rather than the address of the
+// peer.  Only enable it behind a proxy setting the header, as clients
+// can forge it otherwise.
+var TrustForwardedFor = false
+
+// HTTPFields returns the additional fields describing an HTTP request
+// served with the given status in dur, to be passed to WithFields or
+// added to a message: _http_method, _http_path, _http_status (a number),
+// _http_duration_ms (a number) and _http_remote, the IP of the client.
+func HTTPFields(r *http.Request, status int, dur time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		AdditionalFieldPrefix + "http_method":      r.Method,
+		AdditionalFieldPrefix + "http_path":        r.URL.Path,
+		AdditionalFieldPrefix + "http_status":      status,
+		AdditionalFieldPrefix + "http_duration_ms": float64(dur) / float64(time.Millisecond),
+		AdditionalFieldPrefix + "http_remote":      remoteIP(r),
+	}
+}
+
+// remoteIP returns the IP of the client of a request, without the port.
+func remoteIP(r *http.Request) string {
+	if TrustForwardedFor {
+		// the first address is the client, proxies append theirs
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
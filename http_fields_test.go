@@ -0,0 +1,40 @@
+package graylog
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPFields(t *testing.T) {
+	r := httptest.NewRequest("POST", "/orders?id=42", nil)
+	r.RemoteAddr = "192.0.2.10:51234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+
+	fields := HTTPFields(r, 201, 1500*time.Microsecond)
+	expected := map[string]interface{}{
+		"_http_method":      "POST",
+		"_http_path":        "/orders",
+		"_http_status":      201,
+		"_http_duration_ms": 1.5,
+		"_http_remote":      "192.0.2.10",
+	}
+	if len(fields) != len(expected) {
+		t.Errorf("expected %d fields, got %v", len(expected), fields)
+	}
+	for k, v := range expected {
+		if fields[k] != v {
+			t.Errorf("%s: expected %#v, got %#v", k, v, fields[k])
+		}
+	}
+
+	defer func() { TrustForwardedFor = false }()
+	TrustForwardedFor = true
+	if remote := HTTPFields(r, 201, 0)["_http_remote"]; remote != "203.0.113.7" {
+		t.Errorf("expected the forwarded client address, got %v", remote)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if remote := HTTPFields(r, 201, 0)["_http_remote"]; remote != "192.0.2.10" {
+		t.Errorf("expected the peer address without the header, got %v", remote)
+	}
+}
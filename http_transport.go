@@ -2,13 +2,53 @@ package graylog
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sync"
 )
 
+// maxErrorBody is how much of a response body is kept in an HTTPError.
+const maxErrorBody = 1024
+
 type httpTransport struct {
 	client *http.Client
 	url    string
+
+	// credentials sent with basic authentication, when username is set
+	username string
+	password string
+
+	compression      func() bool
+	compressMinSize  func() int
+	compressionLevel func(size int) int
+
+	// tlsConfig is applied to the client before the first message
+	tlsConfig func() *tls.Config
+	tlsOnce   sync.Once
+}
+
+// HTTPError is returned when the GELF HTTP input doesn't answer
+// 202 Accepted to a message.
+type HTTPError struct {
+	StatusCode int
+	Body       string // beginning of the response body
+}
+
+func (e *HTTPError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("gelf: HTTP status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("gelf: HTTP status %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether sending the message again may succeed: server
+// errors are transient, while 4xx errors mean the message was rejected.
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode >= 500
 }
 
 // WriteMessage sends the specified message to the GELF HTTP endpoint
@@ -20,14 +60,77 @@ func (w *httpTransport) WriteMessage(m *Message) (err error) {
 		return
 	}
 
-	buf := bytes.NewBuffer(mBytes)
+	body, gzipped := mBytes, false
+	if w.compression != nil && w.compression() && len(mBytes) >= w.compressMinSize() {
+		if body, err = compress(mBytes, CompressGzip, w.compressionLevel(len(mBytes))); err != nil {
+			return
+		}
+		gzipped = true
+	}
 
-	response, err := w.client.Post(w.url, "application/json", buf)
-	if err == nil && response != nil && response.Body != nil {
-		response.Body.Close()
+	if w.tlsConfig != nil {
+		w.tlsOnce.Do(w.configureTLS)
+	}
+	request, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if w.username != "" {
+		request.SetBasicAuth(w.username, w.password)
+	}
+	if gzipped {
+		request.Header.Set("Content-Encoding", "gzip")
 	}
 
+	response, err := w.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		return &HTTPError{StatusCode: response.StatusCode, Body: string(bytes.TrimSpace(body))}
+	}
+
+	// drain the body so the keep-alive connection can be reused
+	_, err = io.Copy(ioutil.Discard, response.Body)
 	return err
 }
 
+// configureTLS applies the TLS configuration to the client, keeping the
+// client certificate of a CertReloader unless it configures another.
+func (w *httpTransport) configureTLS() {
+	config := w.tlsConfig()
+	if config == nil {
+		return
+	}
+	ht := w.transport()
+	if ht == nil {
+		return
+	}
+	if prev := ht.TLSClientConfig; prev != nil && prev.GetClientCertificate != nil &&
+		config.GetClientCertificate == nil && len(config.Certificates) == 0 {
+		config.GetClientCertificate = prev.GetClientCertificate
+	}
+	ht.TLSClientConfig = config
+}
+
+// transport returns the *http.Transport of the client, creating a clone
+// of http.DefaultTransport, with its timeouts and connection pooling,
+// rather than alter it, as other clients share it.  It returns nil if the
+// client has another kind of RoundTripper.
+func (w *httpTransport) transport() *http.Transport {
+	if w.client.Transport == nil {
+		if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+			w.client.Transport = dt.Clone()
+		} else {
+			w.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+		}
+	}
+	ht, _ := w.client.Transport.(*http.Transport)
+	return ht
+}
+
 func (w *httpTransport) SetCompressType(t CompressType) {}
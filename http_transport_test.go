@@ -0,0 +1,198 @@
+package graylog
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status    int
+		body      string
+		temporary bool
+	}{
+		{http.StatusAccepted, "", false},
+		{http.StatusOK, "ok", false},
+		{http.StatusBadRequest, "invalid GELF message", false},
+		{http.StatusServiceUnavailable, "journal full", true},
+	}
+
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		w, err := NewWriter(ts.URL + "/gelf")
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+
+		err = w.WriteMessage(&Message{Version: "1.1", Short: "message"})
+		ts.Close()
+
+		if tt.status == http.StatusAccepted {
+			if err != nil {
+				t.Errorf("202 should be a success, got %s", err)
+			}
+			continue
+		}
+		httpErr, ok := err.(*HTTPError)
+		if !ok {
+			t.Errorf("status %d: expected an HTTPError, got %#v", tt.status, err)
+			continue
+		}
+		if httpErr.StatusCode != tt.status || httpErr.Body != tt.body {
+			t.Errorf("status %d: unexpected error %q", tt.status, httpErr)
+		}
+		if httpErr.Temporary() != tt.temporary {
+			t.Errorf("status %d: Temporary should be %v", tt.status, tt.temporary)
+		}
+	}
+}
+
+func TestHTTPCompressMinSize(t *testing.T) {
+	type request struct {
+		encoding string
+		short    string
+	}
+	requests := make(chan request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		var m Message
+		json.NewDecoder(body).Decode(&m)
+		requests <- request{r.Header.Get("Content-Encoding"), m.Short}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	w, err := NewWriter(ts.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.HTTPCompression = true
+	w.HTTPCompressMinSize = 1024
+
+	large := strings.Repeat("large ", 500)
+	for _, tt := range []struct {
+		short    string
+		encoding string
+	}{
+		{"small", ""},
+		{large, "gzip"},
+	} {
+		if err := w.WriteMessage(&Message{Version: "1.1", Short: tt.short}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		r := <-requests
+		if r.encoding != tt.encoding {
+			t.Errorf("%d bytes message: expected Content-Encoding %q, got %q", len(tt.short), tt.encoding, r.encoding)
+		}
+		if r.short != tt.short {
+			t.Errorf("%d bytes message: received %d bytes", len(tt.short), len(r.short))
+		}
+	}
+}
+
+func TestHTTPKeepAlive(t *testing.T) {
+	conns := make(chan struct{}, 10)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("accepted"))
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns <- struct{}{}
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	w, err := NewWriter(ts.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.WriteMessage(&Message{Version: "1.1", Short: "message"}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	if n := len(conns); n != 1 {
+		t.Errorf("expected the connection to be reused, got %d connections", n)
+	}
+}
+
+func TestHTTPClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-certs")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := tls.LoadX509KeyPair(writeTestCert(t, dir, 7))
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %s", err)
+	}
+
+	serials := make(chan int64, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serials <- r.TLS.PeerCertificates[0].SerialNumber.Int64()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	w, err := NewWriter(ts.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.TLSConfig = &tls.Config{RootCAs: pool}
+	w.ClientCertificate = &cert
+	if _, err := w.Write([]byte("authenticated")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if serial := <-serials; serial != 7 {
+		t.Errorf("expected the client certificate, got serial %d", serial)
+	}
+	ht := w.Transport.(*httpTransport).client.Transport.(*http.Transport)
+	if ht == http.DefaultTransport || ht.TLSHandshakeTimeout == 0 || ht.MaxIdleConns == 0 {
+		t.Errorf("expected a clone of http.DefaultTransport, got %+v", ht)
+	}
+}
+
+func TestHTTPSRootCAs(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	w, err := NewWriter(ts.URL + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.RootCAs = x509.NewCertPool()
+	w.RootCAs.AddCert(ts.Certificate())
+	w.ServerName = "example.com"
+	if _, err := w.Write([]byte("internal CA")); err != nil {
+		t.Errorf("Write: %s", err)
+	}
+}
@@ -0,0 +1,41 @@
+package graylog
+
+import "encoding/json"
+
+// hybridTransport sends messages over UDP while they fit in a
+// configured payload size, and over TCP to the same host otherwise,
+// which avoids chunking large messages.
+type hybridTransport struct {
+	udp           *udpTransport
+	tcp           *tcpTransport
+	maxUDPPayload func() int
+}
+
+// WriteMessage sends the specified message to the GELF server
+// specified in the call to New().  It assumes all the fields are
+// filled out appropriately.
+func (h *hybridTransport) WriteMessage(m *Message) (err error) {
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	zBytes, err := h.udp.compress(mBytes)
+	if err != nil {
+		return
+	}
+	if len(zBytes) > h.maxUDPPayload() {
+		return h.tcp.send(mBytes)
+	}
+	h.udp.encoded(zBytes)
+	return h.udp.send(zBytes)
+}
+
+// Close closes both connections.
+func (h *hybridTransport) Close() error {
+	err := h.udp.Close()
+	if terr := h.tcp.Close(); err == nil {
+		err = terr
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package graylog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestHybridTransport(t *testing.T) {
+	ur, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	// the TCP input listens on the same address as the UDP one
+	tr := newTCPReader(t, ur.Addr())
+	defer tr.Close()
+
+	w, err := NewHybridWriter(ur.Addr())
+	if err != nil {
+		t.Fatalf("NewHybridWriter: %s", err)
+	}
+	encoded := 0
+	w.OnEncoded = func([]byte) { encoded++ }
+
+	if _, err := w.Write([]byte("small message")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	msg, err := ur.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "small message" {
+		t.Errorf("small message should be sent over UDP, got %q", msg.Short)
+	}
+
+	// random data doesn't compress below the UDP payload limit
+	raw := make([]byte, 4*ChunkSize)
+	rand.Read(raw)
+	large := hex.EncodeToString(raw)
+	if _, err := w.Write([]byte(large)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	select {
+	case msg = <-tr.msgs:
+		if msg.Short != large {
+			t.Errorf("large message should be sent over TCP, got %d bytes", len(msg.Short))
+		}
+	case <-time.After(time.Second):
+		t.Error("large message was not sent over TCP")
+	}
+	if encoded != 1 {
+		t.Errorf("OnEncoded should only be called for the UDP message, got %d calls", encoded)
+	}
+}
@@ -0,0 +1,78 @@
+package graylog
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// KafkaProducer publishes a record to a Kafka topic, waiting for the
+// brokers to acknowledge it, like the synchronous producers of the Kafka
+// clients.  Wrap the producer the application already configures with
+// its brokers and acks setting; producers implementing io.Closer are
+// closed with the transport.
+type KafkaProducer interface {
+	Produce(topic string, key, value []byte) error
+}
+
+// KafkaTransport publishes messages to a Kafka topic consumed by a
+// Graylog GELF Kafka input, each as a record holding the JSON message:
+//
+//	w := graylog.NewTransportWriter(graylog.NewKafkaTransport(producer, "gelf"))
+//
+// Records are keyed by host by default, so that the messages of a host
+// land on the same partition and are consumed in order.
+type KafkaTransport struct {
+	Producer KafkaProducer
+	Topic    string
+
+	// PartitionKey returns the key of the record of a message, which
+	// selects its partition.  It defaults to the host of the message.
+	PartitionKey func(m *Message) []byte
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewKafkaTransport returns a transport publishing to topic with p.
+func NewKafkaTransport(p KafkaProducer, topic string) *KafkaTransport {
+	return &KafkaTransport{Producer: p, Topic: topic}
+}
+
+// WriteMessage publishes the message, returning the error of the
+// producer, or ErrClosed after Close.
+func (t *KafkaTransport) WriteMessage(m *Message) error {
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(m.Host)
+	if t.PartitionKey != nil {
+		key = t.PartitionKey(m)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+	return t.Producer.Produce(t.Topic, key, mBytes)
+}
+
+// Close closes the producer, if it is an io.Closer, which isn't used
+// afterwards.
+func (t *KafkaTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if c, ok := t.Producer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
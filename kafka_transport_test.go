@@ -0,0 +1,77 @@
+package graylog
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// kafkaRecord is a record published to a captureProducer.
+type kafkaRecord struct {
+	topic string
+	key   string
+	msg   Message
+}
+
+type captureProducer struct {
+	records []kafkaRecord
+	err     error
+	closed  bool
+}
+
+func (p *captureProducer) Produce(topic string, key, value []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	r := kafkaRecord{topic: topic, key: string(key)}
+	if err := json.Unmarshal(value, &r.msg); err != nil {
+		return err
+	}
+	p.records = append(p.records, r)
+	return nil
+}
+
+func (p *captureProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestKafkaTransport(t *testing.T) {
+	p := &captureProducer{}
+	kt := NewKafkaTransport(p, "gelf")
+	w := NewTransportWriter(kt)
+
+	if err := w.WriteMessage(&Message{Version: "1.1", Host: "web-1", Short: "published", Extra: map[string]interface{}{"user": "jane"}}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	kt.PartitionKey = func(m *Message) []byte { return []byte(m.Extra["_tenant"].(string)) }
+	w.WriteMessage(&Message{Version: "1.1", Host: "web-1", Short: "keyed", Extra: map[string]interface{}{"_tenant": "acme"}})
+
+	if len(p.records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(p.records))
+	}
+	if r := p.records[0]; r.topic != "gelf" || r.key != "web-1" || r.msg.Short != "published" || r.msg.Extra["_user"] != "jane" {
+		t.Errorf("expected the message keyed by host, got %+v", r)
+	}
+	if r := p.records[1]; r.key != "acme" {
+		t.Errorf("expected the custom partition key, got %q", r.key)
+	}
+
+	kt.PartitionKey = nil
+	p.err = errors.New("leader not available")
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "failed"}); err != p.err {
+		t.Errorf("expected the producer error, got %v", err)
+	}
+	if err := w.Close(); err != nil || !p.closed {
+		t.Errorf("expected the producer closed, got %v", err)
+	}
+	p.err = nil
+	if err := kt.WriteMessage(&Message{Version: "1.1", Short: "closed"}); err != ErrClosed || len(p.records) != 2 {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+
+	if _, err := NewWriter("kafka://broker:9092/gelf"); err == nil || !strings.Contains(err.Error(), "NewKafkaTransport") {
+		t.Errorf("expected kafka:// to point at NewKafkaTransport, got %v", err)
+	}
+}
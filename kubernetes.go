@@ -0,0 +1,60 @@
+package graylog
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// kubernetesEnv are the downward API environment variables read by
+// DetectKubernetes, and the fields they are sent as.  The pod spec has to
+// define them, like:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.name
+var kubernetesEnv = []struct{ env, field string }{
+	{"POD_NAME", "k8s_pod"},
+	{"POD_NAMESPACE", "k8s_namespace"},
+	{"NODE_NAME", "k8s_node"},
+}
+
+// getenv and cgroupFile are the sources of DetectKubernetes, replaced in
+// tests.
+var (
+	getenv     = os.Getenv
+	cgroupFile = "/proc/self/cgroup"
+)
+
+// containerIDPattern matches the 64 hex digits container ids of the
+// cgroup paths of Docker, containerd and CRI-O.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// kubernetesFields returns the fields of DetectKubernetes, detected once.
+func (w *Writer) kubernetesFields() map[string]interface{} {
+	w.k8sOnce.Do(func() {
+		w.k8sFields = detectKubernetes()
+	})
+	return w.k8sFields
+}
+
+// detectKubernetes reads the pod from the downward API environment
+// variables and the container id from the cgroups of the process,
+// skipping what can't be determined.
+func detectKubernetes() map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, e := range kubernetesEnv {
+		if v := getenv(e.env); v != "" {
+			fields[AdditionalFieldPrefix+e.field] = v
+		}
+	}
+	if b, err := ioutil.ReadFile(cgroupFile); err == nil {
+		// the innermost cgroup comes last
+		if ids := containerIDPattern.FindAll(b, -1); len(ids) > 0 {
+			fields[AdditionalFieldPrefix+"container_id"] = string(ids[len(ids)-1])
+		}
+	}
+	return fields
+}
@@ -0,0 +1,60 @@
+package graylog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectKubernetes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-k8s")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f func(string) string, file string) { getenv, cgroupFile = f, file }(getenv, cgroupFile)
+
+	id := "3f4a9c1e2b7d8e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+	cgroupFile = filepath.Join(dir, "cgroup")
+	cgroup := "12:memory:/kubepods/burstable/pod0d3f2c1b-aaaa-bbbb-cccc-1234567890ab/" + id + "\n" +
+		"0::/kubepods.slice/kubepods-burstable.slice/cri-containerd-" + id + ".scope\n"
+	if err := ioutil.WriteFile(cgroupFile, []byte(cgroup), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	env := map[string]string{"POD_NAME": "billing-7d9f8-xk2p4", "POD_NAMESPACE": "payments"}
+	getenv = func(k string) string { return env[k] }
+
+	w, ct := newCaptureWriter()
+	w.Write([]byte("not detected"))
+	if len(ct.last().Extra) != 0 {
+		t.Errorf("fields should only be detected when enabled, got %v", ct.last().Extra)
+	}
+
+	w.DetectKubernetes = true
+	w.Write([]byte("detected"))
+	extra := ct.last().Extra
+	expected := map[string]interface{}{
+		"_k8s_pod":       "billing-7d9f8-xk2p4",
+		"_k8s_namespace": "payments",
+		"_container_id":  id,
+	}
+	if len(extra) != len(expected) {
+		t.Errorf("expected the fields which can be determined, got %v", extra)
+	}
+	for k, v := range expected {
+		if extra[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, extra[k])
+		}
+	}
+
+	// outside of Kubernetes
+	env = nil
+	cgroupFile = filepath.Join(dir, "missing")
+	w, ct = newCaptureWriter()
+	w.DetectKubernetes = true
+	w.Write([]byte("elsewhere"))
+	if len(ct.last().Extra) != 0 {
+		t.Errorf("undetermined fields should be skipped, got %v", ct.last().Extra)
+	}
+}
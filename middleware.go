@@ -0,0 +1,70 @@
+package graylog
+
+import "io"
+
+// TransportFunc is an adapter to use an ordinary function as a Transport.
+type TransportFunc func(m *Message) error
+
+// WriteMessage calls f(m).
+func (f TransportFunc) WriteMessage(m *Message) error {
+	return f(m)
+}
+
+// TransportMiddleware wraps a Transport with additional behavior.
+type TransportMiddleware func(next Transport) Transport
+
+// Use wraps the transport of the writer with the given middlewares.  The
+// first middleware is the outermost one, it sees messages first.  Each
+// call to Use wraps the transport resulting from the previous calls.
+// Use must not be called while the writer is in use.
+//
+// The wrapped transport keeps being closed by Close, and probed by
+// StartProbe.
+func (w *Writer) Use(mw ...TransportMiddleware) {
+	base := unwrapTransport(w.Transport)
+	t := w.Transport
+	for i := len(mw) - 1; i >= 0; i-- {
+		t = mw[i](t)
+	}
+	w.Transport = &middlewareTransport{Transport: t, base: base}
+}
+
+// middlewareTransport sends messages through the middlewares, and keeps
+// the transport they wrap so that it can still be closed.
+type middlewareTransport struct {
+	Transport
+	base Transport
+}
+
+// Close closes the wrapped transport, when it is an io.Closer.
+func (t *middlewareTransport) Close() error {
+	if c, ok := t.base.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// unwrapTransport returns the transport wrapped by the middlewares of Use.
+func unwrapTransport(t Transport) Transport {
+	if m, ok := t.(*middlewareTransport); ok {
+		return m.base
+	}
+	return t
+}
+
+// LoggingMiddleware returns a middleware reporting every message sent,
+// and every failure, to logf (like log.Printf).  It must not log through
+// the writer it wraps.
+func LoggingMiddleware(logf func(format string, v ...interface{})) TransportMiddleware {
+	return func(next Transport) Transport {
+		return TransportFunc(func(m *Message) error {
+			err := next.WriteMessage(m)
+			if err != nil {
+				logf("gelf: sending %q failed: %s", m.Short, err)
+			} else {
+				logf("gelf: sent %q", m.Short)
+			}
+			return err
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package graylog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUseMiddlewares(t *testing.T) {
+	var calls []string
+	tag := func(name string) TransportMiddleware {
+		return func(next Transport) Transport {
+			return TransportFunc(func(m *Message) error {
+				calls = append(calls, name)
+				m.setExtra("_"+name, true)
+				return next.WriteMessage(m)
+			})
+		}
+	}
+
+	w, ct := newCaptureWriter()
+	w.Use(tag("first"), tag("second"))
+	w.Write([]byte("message"))
+
+	if !reflect.DeepEqual(calls, []string{"first", "second"}) {
+		t.Errorf("middlewares should run in order, got %v", calls)
+	}
+	m := ct.last()
+	if m == nil || m.Extra["_first"] != true || m.Extra["_second"] != true {
+		t.Errorf("message should go through both middlewares, got %v", m)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var logged []string
+	logf := func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+
+	w := &Writer{Transport: TransportFunc(func(m *Message) error {
+		if m.Short == "fail" {
+			return errors.New("unreachable")
+		}
+		return nil
+	})}
+	w.Use(LoggingMiddleware(logf))
+	w.Write([]byte("ok"))
+	w.Write([]byte("fail"))
+
+	expected := []string{`gelf: sent "ok"`, `gelf: sending "fail" failed: unreachable`}
+	if !reflect.DeepEqual(logged, expected) {
+		t.Errorf("expected %q, got %q", expected, logged)
+	}
+}
+
+func TestUseKeepsClose(t *testing.T) {
+	w, _ := newCaptureWriter()
+	ct := &closeCountingTransport{}
+	w.Transport = ct
+	w.Use(LoggingMiddleware(t.Logf))
+	w.Use(LoggingMiddleware(t.Logf))
+
+	w.Write([]byte("message"))
+	if ct.last() == nil {
+		t.Fatal("message should go through the middlewares")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if ct.closes != 1 {
+		t.Errorf("the wrapped transport should be closed once, got %d", ct.closes)
+	}
+}
+
+func TestUseKeepsStartProbe(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	w, err := NewWriter(addr)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.Use(LoggingMiddleware(t.Logf))
+	errs := make(chan error, 10)
+	w.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	stop := w.StartProbe(10 * time.Millisecond)
+	defer stop()
+
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("the transport wrapped by the middlewares should be probed")
+	}
+}
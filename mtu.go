@@ -0,0 +1,79 @@
+package graylog
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IP and UDP headers, which the path MTU includes but not the chunks.
+const (
+	udp4Overhead = 20 + 8
+	udp6Overhead = 40 + 8
+)
+
+// pathMTU is readPathMTU, replaced in tests.
+var pathMTU = readPathMTU
+
+// StartMTUCheck reads the path MTU of the UDP connection of the writer
+// every interval, until stop is called, and keeps the chunks within it:
+// when the MTU shrinks, like when a mobile device joins a VPN, chunks
+// sized for the previous network would be fragmented or dropped.  The
+// chunks never exceed MaxChunkSize, and grow back when the MTU does.
+// Failures to read the MTU are passed to OnError.  It does nothing for
+// writers which don't send over UDP.
+func (w *Writer) StartMTUCheck(interval time.Duration) (stop func()) {
+	var udp *udpTransport
+	switch t := unwrapTransport(w.Transport).(type) {
+	case *udpTransport:
+		udp = t
+	case *hybridTransport:
+		udp = t.udp
+	default:
+		return func() {}
+	}
+
+	check := func() {
+		if err := udp.checkMTU(); err != nil {
+			w.reportError(err)
+		}
+	}
+	check()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// checkMTU reads the path MTU of the connection, and sizes the chunks
+// after it.
+func (w *udpTransport) checkMTU() error {
+	conn := w.conn
+	if shared, ok := conn.(*sharedUDPConn); ok {
+		conn = shared.socket.conn
+	}
+	mtu, err := pathMTU(conn)
+	if err != nil {
+		return err
+	}
+	overhead := udp4Overhead
+	if addr, ok := w.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		overhead = udp6Overhead
+	}
+	atomic.StoreInt64(&w.mtuSize, int64(mtu-overhead))
+	return nil
+}
@@ -0,0 +1,33 @@
+package graylog
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// readPathMTU returns the path MTU the kernel knows for the destination
+// of a connected UDP socket.
+func readPathMTU(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return 0, errors.New("gelf: path MTU of a non-UDP connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MTU
+	if addr, ok := uc.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+	}
+	var mtu int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		mtu, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return mtu, serr
+}
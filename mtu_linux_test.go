@@ -0,0 +1,22 @@
+package graylog
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadPathMTU(t *testing.T) {
+	conn, err := net.Dial("udp", "127.0.0.1:12201")
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	mtu, err := readPathMTU(conn)
+	if err != nil {
+		t.Fatalf("readPathMTU: %s", err)
+	}
+	if mtu < 576 {
+		t.Errorf("expected the MTU of the loopback interface, got %d", mtu)
+	}
+}
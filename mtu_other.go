@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package graylog
+
+import (
+	"errors"
+	"net"
+)
+
+// readPathMTU is only implemented on Linux, which exposes the path MTU
+// of connected sockets.
+func readPathMTU(conn net.Conn) (int, error) {
+	return 0, errors.New("gelf: path MTU is not available on this platform")
+}
@@ -0,0 +1,88 @@
+package graylog
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartMTUCheck(t *testing.T) {
+	var mu sync.Mutex
+	mtu := 1500
+	defer func(f func(net.Conn) (int, error)) { pathMTU = f }(pathMTU)
+	pathMTU = func(net.Conn) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return mtu, nil
+	}
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	udp := w.Transport.(*udpTransport)
+
+	stop := w.StartMTUCheck(5 * time.Millisecond)
+	defer stop()
+	if size := udp.size(); size != ChunkSize {
+		t.Errorf("chunks should not exceed ChunkSize, got %d", size)
+	}
+
+	// the device joins a VPN
+	mu.Lock()
+	mtu = 1280
+	mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for udp.size() != 1280-udp4Overhead && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if size := udp.size(); size != 1280-udp4Overhead {
+		t.Fatalf("chunks should shrink to the path MTU, got %d", size)
+	}
+
+	m := largeMessage(4 * ChunkSize)
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	received, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if received.Short != m.Short {
+		t.Error("message should be reassembled from the smaller chunks")
+	}
+}
+
+func TestStartMTUCheckError(t *testing.T) {
+	defer func(f func(net.Conn) (int, error)) { pathMTU = f }(pathMTU)
+	errMTU := errors.New("no route")
+	pathMTU = func(net.Conn) (int, error) { return 0, errMTU }
+
+	w, err := NewWriter("127.0.0.1:12201")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	errs := make(chan error, 1)
+	w.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	w.StartMTUCheck(time.Hour)()
+	if err := <-errs; err != errMTU {
+		t.Errorf("expected the MTU error, got %v", err)
+	}
+	if size := w.Transport.(*udpTransport).size(); size != ChunkSize {
+		t.Errorf("chunks should keep their size, got %d", size)
+	}
+}
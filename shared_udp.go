@@ -0,0 +1,67 @@
+package graylog
+
+import (
+	"net"
+	"sync"
+)
+
+// ShareUDPSockets makes the UDP writers to the same address, and
+// network, share a single socket, rather than open one each, for
+// processes creating a writer per subsystem.  The socket is closed once
+// every writer sharing it is.  Set it _before_ calling NewWriter.
+var ShareUDPSockets = false
+
+var (
+	udpSocketsMu sync.Mutex
+	udpSockets   = make(map[string]*udpSocket)
+)
+
+// udpSocket is a socket shared by UDP transports.  mu serializes the
+// messages sent on it, so that their chunks don't interleave.
+type udpSocket struct {
+	mu   sync.Mutex
+	key  string
+	conn net.Conn
+	refs int
+}
+
+// sharedUDPConn is the handle of a transport on a shared socket.
+type sharedUDPConn struct {
+	net.Conn
+	socket *udpSocket
+	once   sync.Once
+}
+
+// dialShared returns a handle on the shared socket to addr, dialing it
+// if no transport holds one.
+func dialShared(network, addr string, dial func(network, addr string) (net.Conn, error)) (*sharedUDPConn, error) {
+	key := network + "://" + addr
+	udpSocketsMu.Lock()
+	defer udpSocketsMu.Unlock()
+
+	s, ok := udpSockets[key]
+	if !ok {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		s = &udpSocket{key: key, conn: conn}
+		udpSockets[key] = s
+	}
+	s.refs++
+	return &sharedUDPConn{Conn: s.conn, socket: s}, nil
+}
+
+// Close releases the socket, which is closed once no handle holds it.
+// Closing a handle again does nothing.
+func (c *sharedUDPConn) Close() (err error) {
+	c.once.Do(func() {
+		udpSocketsMu.Lock()
+		defer udpSocketsMu.Unlock()
+		if c.socket.refs--; c.socket.refs == 0 {
+			delete(udpSockets, c.socket.key)
+			err = c.socket.conn.Close()
+		}
+	})
+	return
+}
@@ -0,0 +1,65 @@
+package graylog
+
+import "testing"
+
+func TestShareUDPSockets(t *testing.T) {
+	defer func(share bool) { ShareUDPSockets = share }(ShareUDPSockets)
+	ShareUDPSockets = true
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	addr := r.Addr()
+
+	w1, err := NewWriter(addr)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w2, err := NewWriter("udp://" + addr)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	c1 := unwrapTransport(w1.Transport).(*udpTransport).conn.(*sharedUDPConn)
+	c2 := unwrapTransport(w2.Transport).(*udpTransport).conn.(*sharedUDPConn)
+	if c1.socket != c2.socket {
+		t.Fatalf("expected the writers to share a socket, got %s and %s", c1.LocalAddr(), c2.LocalAddr())
+	}
+
+	for _, w := range []*Writer{w1, w2} {
+		if _, err := w.Write([]byte("shared")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if m, err := r.ReadMessage(); err != nil || m.Short != "shared" {
+			t.Fatalf("ReadMessage: %v %v", m, err)
+		}
+	}
+
+	if err := w1.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	w1.Close()
+	if _, err := w2.Write([]byte("still open")); err != nil {
+		t.Errorf("the socket should stay open for the other writer, got %s", err)
+	}
+	if err := w2.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err := c1.socket.conn.Write([]byte("closed")); err == nil {
+		t.Errorf("the socket should be closed once both writers are")
+	}
+	udpSocketsMu.Lock()
+	if len(udpSockets) != 0 {
+		t.Errorf("expected the socket released, got %v", udpSockets)
+	}
+	udpSocketsMu.Unlock()
+
+	w3, err := NewWriter(addr)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w3.Close()
+	if c3 := unwrapTransport(w3.Transport).(*udpTransport).conn.(*sharedUDPConn); c3.socket == c1.socket {
+		t.Errorf("expected a new socket once the other one is closed")
+	}
+}
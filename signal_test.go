@@ -0,0 +1,102 @@
+//go:build !windows
+// +build !windows
+
+package graylog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// slowStdoutTransport prints messages to stdout after a delay, so that
+// they are still queued when the signal is received.
+type slowStdoutTransport struct{}
+
+func (slowStdoutTransport) WriteMessage(m *Message) error {
+	time.Sleep(100 * time.Millisecond)
+	fmt.Printf("sent: %s\n", m.Short)
+	return nil
+}
+
+func TestFlushOnSignalHelper(t *testing.T) {
+	if os.Getenv("GRAYLOG_FLUSH_HELPER") != "1" {
+		return
+	}
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	hook.SetWriter(&Writer{Transport: slowStdoutTransport{}})
+	hook.FlushOnSignal(syscall.SIGTERM)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Hooks.Add(hook)
+	log.Info("last words")
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	time.Sleep(5 * time.Second)
+	fmt.Println("not terminated")
+}
+
+func TestFlushOnSignal(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestFlushOnSignalHelper")
+	cmd.Env = append(os.Environ(), "GRAYLOG_FLUSH_HELPER=1")
+	out, err := cmd.Output()
+
+	if !strings.Contains(string(out), "sent: last words") {
+		t.Errorf("queued message should be flushed before exiting, got %q", out)
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("process should be terminated by the signal, got %v and %q", err, out)
+	}
+	if status := exitErr.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Errorf("process should be terminated by SIGTERM, got %s", exitErr)
+	}
+}
+
+func TestWriterFlushOnSignalHelper(t *testing.T) {
+	if os.Getenv("GRAYLOG_FLUSH_HELPER") != "writer" {
+		return
+	}
+
+	w := &Writer{Transport: slowStdoutTransport{}}
+	w.FlushOnSignal(syscall.SIGTERM)
+
+	go w.Write([]byte("last words"))
+	for w.pendingCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	time.Sleep(5 * time.Second)
+	fmt.Println("not terminated")
+}
+
+func TestWriterFlushOnSignal(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestWriterFlushOnSignalHelper")
+	cmd.Env = append(os.Environ(), "GRAYLOG_FLUSH_HELPER=writer")
+	out, err := cmd.Output()
+
+	if !strings.Contains(string(out), "sent: last words") {
+		t.Errorf("message being written should be sent before exiting, got %q", out)
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("process should be terminated by the signal, got %v and %q", err, out)
+	}
+	if status := exitErr.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Errorf("process should be terminated by SIGTERM, got %s", exitErr)
+	}
+}
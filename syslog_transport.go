@@ -0,0 +1,166 @@
+package graylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// syslogFacilityUser is the syslog facility code of user-level messages.
+	syslogFacilityUser = 1
+	// syslogSDID is the structured data element holding the additional
+	// fields, 32473 being the enterprise number reserved for documentation.
+	syslogSDID = "gelf@32473"
+)
+
+// syslogTransport sends messages to a syslog server over UDP, formatted as
+// RFC 5424 lines with the additional fields as structured data.
+type syslogTransport struct {
+	conn net.Conn
+}
+
+// Close closes the connection.
+func (t *syslogTransport) Close() error {
+	return t.conn.Close()
+}
+
+// WriteMessage sends the specified message to the syslog server
+// specified in the call to New().  It assumes all the fields are
+// filled out appropriately.
+func (t *syslogTransport) WriteMessage(m *Message) (err error) {
+	line := formatSyslog(m)
+
+	n, err := t.conn.Write(line)
+	if err != nil {
+		return
+	}
+	if n != len(line) {
+		return fmt.Errorf("bad write (%d/%d)", n, len(line))
+	}
+
+	return nil
+}
+
+// formatSyslog formats a message as an RFC 5424 syslog line.  The GELF
+// level is already a syslog severity.
+func formatSyslog(m *Message) []byte {
+	severity := m.Level
+	if severity < 0 || severity > 7 {
+		severity = 6 // info
+	}
+
+	timestamp := "-"
+	if m.TimeUnix != 0 {
+		sec := int64(m.TimeUnix)
+		nsec := int64((m.TimeUnix - float64(sec)) * 1e9)
+		timestamp = time.Unix(sec, nsec).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d - ", syslogFacilityUser*8+severity, timestamp,
+		syslogHeaderField(m.Host, 255), syslogHeaderField(m.Facility, 48), os.Getpid())
+	writeSyslogSD(&buf, m)
+
+	msg := m.Full
+	if msg == "" {
+		msg = m.Short
+	}
+	if msg != "" {
+		buf.WriteString(" \xef\xbb\xbf") // BOM, the message is UTF-8
+		buf.WriteString(msg)
+	}
+	return buf.Bytes()
+}
+
+// writeSyslogSD writes the file, line and additional fields of a message
+// as a single structured data element, or the nil value if there are none.
+func writeSyslogSD(buf *bytes.Buffer, m *Message) {
+	params := make(map[string]string, len(m.Extra)+2)
+	if m.File != "" {
+		params["file"] = m.File
+	}
+	if m.Line != 0 {
+		params["line"] = strconv.Itoa(m.Line)
+	}
+	for k, v := range m.Extra {
+		if name := syslogParamName(k); name != "" {
+			params[name] = syslogParamValue(v)
+		}
+	}
+
+	if len(params) == 0 {
+		buf.WriteByte('-')
+		return
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf.WriteString("[" + syslogSDID)
+	for _, name := range names {
+		fmt.Fprintf(buf, ` %s="%s"`, name, syslogEscaper.Replace(params[name]))
+	}
+	buf.WriteByte(']')
+}
+
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField returns a header field restricted to printable ASCII,
+// or the nil value if it's empty.
+func syslogHeaderField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return s
+}
+
+// syslogParamName turns an additional field key into a valid structured
+// data parameter name.
+func syslogParamName(k string) string {
+	k = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, strings.TrimPrefix(k, "_"))
+	if len(k) > 32 {
+		k = k[:32]
+	}
+	return k
+}
+
+// syslogParamValue formats a field value the way it would appear in the
+// GELF JSON, without the quotes around strings.
+func syslogParamValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		return s
+	}
+	return string(b)
+}
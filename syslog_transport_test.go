@@ -0,0 +1,66 @@
+package graylog
+
+import (
+	"net"
+	"regexp"
+	"testing"
+)
+
+func TestFormatSyslog(t *testing.T) {
+	m := &Message{
+		Version:  "1.1",
+		Host:     "testing.local",
+		Short:    "test message",
+		TimeUnix: 1496320200.5,
+		Level:    SyslogErrorLevel,
+		Facility: "api",
+		File:     "main.go",
+		Line:     42,
+		Extra: map[string]interface{}{
+			"_user":  `o"reilly]`,
+			"_count": 3,
+		},
+	}
+
+	line := string(formatSyslog(m))
+	expected := regexp.MustCompile(`^<15>1 2017-06-01T12:30:00\.500Z testing\.local api \d+ - ` +
+		`\[gelf@32473 count="3" file="main\.go" line="42" user="o\\"reilly\\]"\] \x{feff}test message$`)
+	if !expected.MatchString(line) {
+		t.Errorf("unexpected syslog line: %q", line)
+	}
+}
+
+func TestFormatSyslogNilValues(t *testing.T) {
+	line := string(formatSyslog(&Message{Level: SyslogInfoLevel}))
+	expected := regexp.MustCompile(`^<14>1 - - - \d+ - -$`)
+	if !expected.MatchString(line) {
+		t.Errorf("unexpected syslog line: %q", line)
+	}
+}
+
+func TestWritingToSyslog(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer l.Close()
+
+	w, err := NewWriter("syslog://" + l.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.Facility = "api"
+	if _, err := w.Write([]byte("test message")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	buf := make([]byte, ChunkSize)
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	expected := regexp.MustCompile(`^<14>1 \S+ \S+ api \d+ - \[gelf@32473 file="\S+" line="\d+"\] \x{feff}test message$`)
+	if !expected.MatchString(string(buf[:n])) {
+		t.Errorf("unexpected syslog line: %q", buf[:n])
+	}
+}
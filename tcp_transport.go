@@ -0,0 +1,247 @@
+package graylog
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tcpTransport sends messages to a GELF TCP input, or over a Unix stream
+// socket.  GELF over TCP
+// supports neither compression nor chunking: every message is sent as
+// plain JSON terminated by a null byte, or by delim when it is set.
+type tcpTransport struct {
+	mu      sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+	closed  bool
+	delim   byte
+
+	// dialing is the redial in flight, shared by every sender finding
+	// the connection dropped, so an outage doesn't turn into a
+	// thundering herd of dials against the recovering collector.
+	dialing *dialCall
+
+	dial func(network, addr string) (net.Conn, error)
+
+	// tlsConfig is the configuration of the TLS connections, nil for
+	// plain TCP.  timeout bounds their handshake, zero meaning no limit.
+	tlsConfig func() *tls.Config
+	timeout   func() time.Duration
+}
+
+// dialCall is a redial in flight.  done is closed once err is set.
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newTCPTransport(addr string, dial func(network, addr string) (net.Conn, error)) (*tcpTransport, error) {
+	return newStreamTransport("tcp", addr, dial)
+}
+
+// newUnixTransport returns a transport over the Unix stream socket at
+// path, for a local relay like a sidecar, with the framing of TCP.
+func newUnixTransport(path string, dial func(network, addr string) (net.Conn, error)) (*tcpTransport, error) {
+	return newStreamTransport("unix", path, dial)
+}
+
+func newStreamTransport(network, addr string, dial func(network, addr string) (net.Conn, error)) (*tcpTransport, error) {
+	conn, err := dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpTransport{network: network, addr: addr, conn: conn, dial: dial}, nil
+}
+
+// newNDJSONTransport returns a TCP transport sending newline delimited
+// JSON messages, the framing of Beats-style line inputs, like a Graylog
+// Raw/Plaintext TCP input with a JSON extractor or a Logstash json_lines
+// codec.  encoding/json escapes newlines, so messages never contain one.
+func newNDJSONTransport(addr string, dial func(network, addr string) (net.Conn, error)) (*tcpTransport, error) {
+	t, err := newTCPTransport(addr, dial)
+	if err != nil {
+		return nil, err
+	}
+	t.delim = '\n'
+	return t, nil
+}
+
+// newTLSTransport returns a TCP transport over TLS, for GELF TCP inputs
+// with TLS enabled.  The connection is dialed right away, but the
+// handshake only happens before the first message, so that the
+// configuration returned by tlsConfig can be set after the transport is
+// created.  The handshake must complete within the duration returned by
+// timeout, so that a server stalling it doesn't block the senders.
+func newTLSTransport(addr string, dial func(network, addr string) (net.Conn, error), tlsConfig func() *tls.Config, timeout func() time.Duration) (*tcpTransport, error) {
+	t, err := newTCPTransport(addr, dial)
+	if err != nil {
+		return nil, err
+	}
+	t.tlsConfig = tlsConfig
+	t.timeout = timeout
+	return t, nil
+}
+
+// WriteMessage sends the specified message to the GELF TCP input
+// specified in the call to New().  It assumes all the fields are
+// filled out appropriately.
+func (t *tcpTransport) WriteMessage(m *Message) (err error) {
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	return t.send(mBytes)
+}
+
+// send writes a serialized message followed by the delimiter.
+// A failed connection is dropped, and dialed again on the next send.
+// Over a Unix socket, the message is sent again right away on a new
+// connection if the relay closed the previous one, the broken pipe
+// meaning nothing of it was read.
+func (t *tcpTransport) send(mBytes []byte) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frame := make([]byte, len(mBytes)+1)
+	copy(frame, mBytes)
+	frame[len(mBytes)] = t.delim
+	for retried := false; ; retried = true {
+		if err = t.connect(); err != nil {
+			return
+		}
+
+		var n int
+		n, err = t.conn.Write(frame)
+		if err == nil && n != len(frame) {
+			err = fmt.Errorf("bad write (%d/%d)", n, len(frame))
+		}
+		if err == nil {
+			return
+		}
+		t.conn.Close()
+		t.conn = nil
+		if retried || t.network != "unix" || !isBrokenPipe(err) {
+			return
+		}
+	}
+}
+
+// isBrokenPipe reports whether err is the EPIPE of a write to a
+// connection closed by the peer.
+func isBrokenPipe(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.EPIPE
+}
+
+// connect dials the connection if it was dropped, and secures new
+// connections with TLS if it is configured.  Only one dial is in flight
+// at a time: concurrent senders wait for its result, and fail with its
+// error, rather than dialing themselves.  t.mu must be held; it is
+// released during the dial.
+func (t *tcpTransport) connect() error {
+	for t.conn == nil {
+		if t.closed {
+			return ErrClosed
+		}
+		if c := t.dialing; c != nil {
+			t.mu.Unlock()
+			<-c.done
+			t.mu.Lock()
+			if c.err != nil {
+				return c.err
+			}
+			continue
+		}
+
+		c := &dialCall{done: make(chan struct{})}
+		t.dialing = c
+		t.mu.Unlock()
+		conn, err := t.dial(t.network, t.addr)
+		t.mu.Lock()
+		t.dialing = nil
+		c.err = err
+		close(c.done)
+		if err != nil {
+			return err
+		}
+		if t.closed {
+			conn.Close()
+			return ErrClosed
+		}
+		t.conn = conn
+	}
+	if t.tlsConfig != nil {
+		if _, ok := t.conn.(*tls.Conn); !ok {
+			conn, err := t.handshake(t.conn)
+			if err != nil {
+				t.conn = nil
+				return err
+			}
+			t.conn = conn
+		}
+	}
+	return nil
+}
+
+// handshake secures conn with TLS, closing it if the handshake fails or
+// times out.  The server name defaults to the host of the address.
+func (t *tcpTransport) handshake(conn net.Conn) (net.Conn, error) {
+	config := &tls.Config{}
+	if c := t.tlsConfig(); c != nil {
+		config = c.Clone()
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(t.addr); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	if d := t.timeout(); d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("gelf: TLS handshake with %s: %s", t.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// reconnect drops the connection, which is dialed again on the next send.
+func (t *tcpTransport) reconnect() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// Close closes the connection, which isn't dialed again.
+func (t *tcpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
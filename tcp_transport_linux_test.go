@@ -0,0 +1,62 @@
+package graylog
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAlive returns whether keep-alive probes are enabled on conn, and
+// their idle period in seconds.
+func keepAlive(t *testing.T, conn net.Conn) (enabled bool, idle int) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %s", err)
+	}
+	var on int
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if on, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); serr != nil {
+			return
+		}
+		idle, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err != nil || serr != nil {
+		t.Fatalf("getsockopt: %v, %v", err, serr)
+	}
+	return on != 0, idle
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	r := newTCPReader(t, "127.0.0.1:0")
+	defer r.Close()
+
+	w, err := NewWriter("tcp://" + r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	if enabled, idle := keepAlive(t, w.Transport.(*tcpTransport).conn); !enabled || idle != 30 {
+		t.Errorf("expected keep-alive probes after 30s by default, got %v after %ds", enabled, idle)
+	}
+
+	w.KeepAlivePeriod = 10 * time.Second
+	conn, err := w.dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	if enabled, idle := keepAlive(t, conn); !enabled || idle != 10 {
+		t.Errorf("expected keep-alive probes after 10s, got %v after %ds", enabled, idle)
+	}
+	conn.Close()
+
+	w.KeepAlivePeriod = 0
+	if conn, err = w.dial("tcp", r.Addr()); err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	if enabled, _ := keepAlive(t, conn); enabled {
+		t.Error("a zero KeepAlivePeriod should disable keep-alive")
+	}
+	conn.Close()
+}
@@ -0,0 +1,491 @@
+package graylog
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpReader accepts GELF TCP connections and decodes the null byte
+// delimited messages sent over them.
+type tcpReader struct {
+	listener net.Listener
+	msgs     chan *Message
+}
+
+func newTCPReader(t *testing.T, addr string) *tcpReader {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	return serveTCP(l)
+}
+
+// serveTCP returns a tcpReader accepting the connections of l.
+func serveTCP(l net.Listener) *tcpReader {
+	r := &tcpReader{listener: l, msgs: make(chan *Message, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+// newTLSReader returns a tcpReader over TLS, with the certificate of an
+// httptest server, valid for 127.0.0.1, and the pool trusting it.
+func newTLSReader(t *testing.T, config *tls.Config) (*tcpReader, *x509.CertPool) {
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.Certificates = ts.TLS.Certificates
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	return serveTCP(l), pool
+}
+
+func (r *tcpReader) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		frame, err := br.ReadBytes(0)
+		if err != nil {
+			return
+		}
+		m := new(Message)
+		if err := json.Unmarshal(frame[:len(frame)-1], m); err != nil {
+			return
+		}
+		r.msgs <- m
+	}
+}
+
+func (r *tcpReader) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *tcpReader) Close() error {
+	return r.listener.Close()
+}
+
+func TestWritingToTCP(t *testing.T) {
+	r := newTCPReader(t, "127.0.0.1:0")
+	defer r.Close()
+
+	w, err := NewWriter("tcp://" + r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+
+	msgData := "test message\nsecond line"
+	if _, err := w.Write([]byte(msgData)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	msg := <-r.msgs
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %s, got %s", "test message", msg.Short)
+	}
+	if msg.Full != msgData {
+		t.Errorf("msg.Full: expected %s, got %s", msgData, msg.Full)
+	}
+}
+
+func TestTCPClose(t *testing.T) {
+	r := newTCPReader(t, "127.0.0.1:0")
+	defer r.Close()
+
+	w, err := NewWriter("tcp://" + r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err := w.Write([]byte("closed")); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestWritingNDJSON(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	lines := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadBytes('\n')
+		lines <- line
+	}()
+
+	w, err := NewWriter("ndjson://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	m := &Message{
+		Version: "1.1",
+		Host:    "testing.local",
+		Short:   "sample",
+		Full:    "sample\nwith a second line",
+		Level:   3,
+		Extra:   map[string]interface{}{"_service": "api"},
+	}
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	expected, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	expected = append(expected, '\n')
+
+	select {
+	case line := <-lines:
+		if string(line) != string(expected) {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no line received")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	DefaultDialTimeout = 200 * time.Millisecond
+	defer func() { DefaultDialTimeout = 5 * time.Second }()
+
+	for _, addr := range []string{"tcp://graylog.invalid:12201", "graylog.invalid:12201"} {
+		start := time.Now()
+		if _, err := NewWriter(addr); err == nil {
+			t.Errorf("%s: expected an error", addr)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: NewWriter should fail within the dial timeout, took %s", addr, elapsed)
+		}
+	}
+}
+
+func TestTCPSingleRedial(t *testing.T) {
+	r := newTCPReader(t, "127.0.0.1:0")
+	defer r.Close()
+
+	var dials int32
+	var fail atomic.Value
+	fail.Store(true)
+	release := make(chan struct{})
+	tr := &tcpTransport{network: "tcp", addr: r.Addr(), dial: func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		if fail.Load().(bool) {
+			return nil, errors.New("connection refused")
+		}
+		return net.Dial(network, addr)
+	}}
+	defer tr.Close()
+
+	const writers = 50
+	outage := func() []error {
+		var started sync.WaitGroup
+		var wg sync.WaitGroup
+		errs := make([]error, writers)
+		started.Add(writers)
+		wg.Add(writers)
+		for i := 0; i < writers; i++ {
+			go func(i int) {
+				defer wg.Done()
+				started.Done()
+				errs[i] = tr.send([]byte(`{"short_message":"outage"}`))
+			}(i)
+		}
+		started.Wait()
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+		wg.Wait()
+		return errs
+	}
+
+	for i, err := range outage() {
+		if err == nil || err.Error() != "connection refused" {
+			t.Fatalf("writer %d: expected the dial error, got %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("expected a single dial for the failed window, got %d", n)
+	}
+
+	fail.Store(false)
+	for i, err := range outage() {
+		if err != nil {
+			t.Fatalf("writer %d: %s", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("expected a single dial for the recovered window, got %d", n-1)
+	}
+	for i := 0; i < writers; i++ {
+		select {
+		case <-r.msgs:
+		case <-time.After(time.Second):
+			t.Fatalf("received only %d of %d messages", i, writers)
+		}
+	}
+}
+
+func TestWritingToTLS(t *testing.T) {
+	r, pool := newTLSReader(t, nil)
+	defer r.Close()
+
+	w, err := NewWriter("tls://" + r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.TLSConfig = &tls.Config{RootCAs: pool}
+
+	if _, err := w.Write([]byte("secured")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	select {
+	case m := <-r.msgs:
+		if m.Short != "secured" {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no message received")
+	}
+}
+
+func TestTLSHandshakeError(t *testing.T) {
+	r, _ := newTLSReader(t, nil)
+	defer r.Close()
+	plain := newTCPReader(t, "127.0.0.1:0")
+	defer plain.Close()
+
+	for _, addr := range []string{r.Addr(), plain.Addr()} {
+		w, err := NewWriter("tls://" + addr)
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+		w.TLSConfig = &tls.Config{}
+		if addr == plain.Addr() {
+			w.TLSConfig.InsecureSkipVerify = true
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, err := w.Write([]byte("refused"))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || !strings.HasPrefix(err.Error(), "gelf: TLS handshake with "+addr) {
+				t.Errorf("%s: expected the handshake error, got %v", addr, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s: the handshake should fail", addr)
+		}
+		w.Close()
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// accept the connections but never answer the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	w, err := NewWriter("tls://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.DialTimeout = 100 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("stalled"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.HasPrefix(err.Error(), "gelf: TLS handshake with ") {
+			t.Errorf("expected the handshake error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the handshake should time out")
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-certs")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := tls.LoadX509KeyPair(writeTestCert(t, dir, 42))
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %s", err)
+	}
+
+	serials := make(chan int64, 4)
+	r, pool := newTLSReader(t, &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			c, err := x509.ParseCertificate(raw[0])
+			if err == nil {
+				serials <- c.SerialNumber.Int64()
+			}
+			return err
+		},
+	})
+	defer r.Close()
+
+	for _, loader := range []bool{false, true} {
+		w, err := NewWriter("tls://" + r.Addr())
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+		w.TLSConfig = &tls.Config{RootCAs: pool}
+		if loader {
+			w.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert, nil }
+		} else {
+			w.ClientCertificate = &cert
+		}
+		if _, err := w.Write([]byte("authenticated")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		select {
+		case <-r.msgs:
+		case <-time.After(time.Second):
+			t.Fatalf("loader %v: no message received", loader)
+		}
+		if serial := <-serials; serial != 42 {
+			t.Errorf("loader %v: expected the client certificate, got serial %d", loader, serial)
+		}
+		w.Close()
+	}
+}
+
+func TestTLSVerification(t *testing.T) {
+	r, pool := newTLSReader(t, nil)
+	defer r.Close()
+
+	for _, tc := range []struct {
+		name   string
+		config func(w *Writer)
+		ok     bool
+	}{
+		{"default pool", func(w *Writer) {}, false},
+		{"custom pool", func(w *Writer) { w.RootCAs = pool }, true},
+		{"server name", func(w *Writer) { w.RootCAs, w.ServerName = pool, "example.com" }, true},
+		{"wrong server name", func(w *Writer) { w.RootCAs, w.ServerName = pool, "graylog.internal" }, false},
+		{"overriding TLSConfig", func(w *Writer) {
+			w.TLSConfig = &tls.Config{ServerName: "graylog.internal"}
+			w.RootCAs, w.ServerName = pool, "127.0.0.1"
+		}, true},
+		{"skip verify", func(w *Writer) { w.InsecureSkipVerify = true }, true},
+	} {
+		w, err := NewWriter("tls://" + r.Addr())
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+		tc.config(w)
+		_, err = w.Write([]byte(tc.name))
+		if tc.ok && err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if !tc.ok && (err == nil || !strings.Contains(err.Error(), "certific")) {
+			t.Errorf("%s: expected a verification error, got %v", tc.name, err)
+		}
+		if tc.ok {
+			select {
+			case <-r.msgs:
+			case <-time.After(time.Second):
+				t.Errorf("%s: no message received", tc.name)
+			}
+		}
+		w.Close()
+	}
+}
+
+func TestWritingToUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-unix")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gelf.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+
+	w, err := NewWriter("unix://" + path)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	// the relay restarts, closing the connection of the writer
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	conn.Close()
+	r := serveTCP(l)
+	defer r.Close()
+
+	for _, msg := range []string{"after the restart", "and one more"} {
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		select {
+		case m := <-r.msgs:
+			if m.Short != msg {
+				t.Errorf("expected %q, got %q", msg, m.Short)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q wasn't received", msg)
+		}
+	}
+}
@@ -6,21 +6,26 @@ import (
 	"compress/zlib"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Used to control GELF chunking.  Should be less than (MTU - len(UDP
-// header)).
-//
-// TODO: generate dynamically using Path MTU Discovery?
+// header)), see StartMTUCheck to follow the path MTU.
 const (
 	ChunkSize        = 1420
 	chunkedHeaderLen = 12
-	chunkedDataLen   = ChunkSize - chunkedHeaderLen
 )
 
+// ErrMessageTooLarge is returned for messages which can't be sent over UDP,
+// even chunked.
+var ErrMessageTooLarge = errors.New("gelf: message too large")
+
 var (
 	magicChunked = []byte{0x1e, 0x0f}
 	magicZlib    = []byte{0x78}
@@ -30,21 +35,132 @@ var (
 // numChunks returns the number of GELF chunks necessary to transmit
 // the given compressed buffer.
 func numChunks(b []byte) int {
+	return numChunksOf(b, ChunkSize)
+}
+
+// numChunksOf returns the number of chunks of chunkSize bytes, header
+// included, necessary to transmit the given compressed buffer.
+func numChunksOf(b []byte, chunkSize int) int {
 	lenB := len(b)
-	if lenB <= ChunkSize {
+	if lenB <= chunkSize {
 		return 1
 	}
-	return len(b)/chunkedDataLen + 1
+	return len(b)/(chunkSize-chunkedHeaderLen) + 1
 }
 
 type udpTransport struct {
-	conn             net.Conn
-	compressionType  func() CompressType
-	compressionLevel func() int
+	mtuSize int64 // chunk size fitting the path MTU, see StartMTUCheck; atomic, first for alignment
+
+	conn                net.Conn
+	compressionType     func() CompressType
+	compressionLevel    func(size int) int
+	maxUncompressedSize func() int
+	chunkWriter         func() ChunkWriter
+	onEncoded           func() func([]byte)
+	chunkSize           func() int
+	parallelChunks      func() int
+	chunkDelay          func() time.Duration
+
+	sendMu *sync.Mutex // serializes the messages on a shared socket, see ShareUDPSockets
+
+	pcMu sync.Mutex
+	pc   net.PacketConn // unconnected socket of parallel writes
+}
+
+// size returns the size of the chunks, ChunkSize unless the writer
+// configures it, lowered to fit the path MTU if it is checked.
+func (w *udpTransport) size() int {
+	size := ChunkSize
+	if w.chunkSize != nil {
+		if n := w.chunkSize(); n > chunkedHeaderLen {
+			size = n
+		}
+	}
+	if n := int(atomic.LoadInt64(&w.mtuSize)); n > chunkedHeaderLen && n < size {
+		size = n
+	}
+	return size
+}
+
+// ChunkWriter transmits the chunks of the messages sent over UDP, to
+// instrument them or to simulate packet loss.  WriteChunk is called for
+// each chunk, index out of total, and is expected to write it to conn
+// unless it drops it.  Returned errors abort the message.
+type ChunkWriter interface {
+	WriteChunk(conn io.Writer, chunk []byte, index, total int) (int, error)
+}
+
+// The ChunkWriterFunc type is an adapter to allow the use of ordinary
+// functions as ChunkWriter.
+type ChunkWriterFunc func(conn io.Writer, chunk []byte, index, total int) (int, error)
+
+// WriteChunk calls f(conn, chunk, index, total).
+func (f ChunkWriterFunc) WriteChunk(conn io.Writer, chunk []byte, index, total int) (int, error) {
+	return f(conn, chunk, index, total)
+}
+
+// writeChunk transmits a chunk through the ChunkWriter of the writer, or
+// straight to the connection when there is none.
+func (w *udpTransport) writeChunk(conn io.Writer, chunk []byte, index, total int) (int, error) {
+	if w.chunkWriter != nil {
+		if cw := w.chunkWriter(); cw != nil {
+			return cw.WriteChunk(conn, chunk, index, total)
+		}
+	}
+	return conn.Write(chunk)
+}
+
+// Close closes the connection, and the socket of parallel writes.
+func (w *udpTransport) Close() error {
+	err := w.conn.Close()
+	w.pcMu.Lock()
+	if w.pc != nil {
+		w.pc.Close()
+		w.pc = nil
+	}
+	w.pcMu.Unlock()
+	return err
+}
+
+// StartProbe writes an empty datagram every interval on the UDP
+// connection of the writer, until stop is called.  A connected UDP socket
+// only reports ICMP errors, like an unreachable port, on the writes
+// following them, which may be minutes away in a quiet service: probing
+// passes them to OnError promptly.  It does nothing for writers which
+// don't send over UDP.
+func (w *Writer) StartProbe(interval time.Duration) (stop func()) {
+	var udp *udpTransport
+	switch t := unwrapTransport(w.Transport).(type) {
+	case *udpTransport:
+		udp = t
+	case *hybridTransport:
+		udp = t.udp
+	default:
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := udp.conn.Write(nil); err != nil && w.OnError != nil {
+					w.OnError(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
 }
 
 type bufferedWriter struct {
-	buffer *bytes.Buffer
+	buffer io.Writer
 }
 
 func (bw bufferedWriter) Write(p []byte) (n int, err error) {
@@ -65,28 +181,111 @@ func (w *udpTransport) WriteMessage(m *Message) (err error) {
 		return
 	}
 
-	var zBuf bytes.Buffer
-	var zw io.WriteCloser
-	switch w.compressionType() {
-	case CompressGzip:
-		zw, err = gzip.NewWriterLevel(&zBuf, w.compressionLevel())
-	case CompressZlib:
-		zw, err = zlib.NewWriterLevel(&zBuf, w.compressionLevel())
-	case NoCompress:
-		zw = bufferedWriter{buffer: &zBuf}
-	default:
-		panic(fmt.Sprintf("unknown compression type %d", w.compressionType()))
+	if w.tooLarge(mBytes) {
+		return ErrMessageTooLarge
+	}
+
+	zBytes, err := w.compress(mBytes)
+	if err != nil {
+		return
+	}
+	w.encoded(zBytes)
+
+	return w.send(zBytes)
+}
+
+// encoded passes the compressed message to the OnEncoded callback of the
+// writer, if any.
+func (w *udpTransport) encoded(zBytes []byte) {
+	if w.onEncoded != nil {
+		if cb := w.onEncoded(); cb != nil {
+			cb(zBytes)
+		}
+	}
+}
+
+// tooLarge reports whether a serialized message is too large to be sent,
+// so compressing it can be skipped.  Uncompressed messages are checked
+// against the chunking limit, compressed ones against the maximum
+// uncompressed size, if any.
+func (w *udpTransport) tooLarge(mBytes []byte) bool {
+	if w.compressionType() == NoCompress {
+		return len(mBytes) > 255*(w.size()-chunkedHeaderLen)-1
 	}
+	if w.maxUncompressedSize == nil {
+		return false
+	}
+	max := w.maxUncompressedSize()
+	return max > 0 && len(mBytes) > max
+}
+
+// compress compresses the serialized message with the configured
+// compression type, at the level configured for its size.
+func (w *udpTransport) compress(mBytes []byte) ([]byte, error) {
+	return compress(mBytes, w.compressionType(), w.compressionLevel(len(mBytes)))
+}
+
+// Compressor returns a writer compressing to w at the given level,
+// which is one of the consts from compress/flate.
+type Compressor func(w io.Writer, level int) (io.WriteCloser, error)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[CompressType]Compressor{
+		CompressGzip: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		CompressZlib: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		NoCompress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return bufferedWriter{buffer: w}, nil
+		},
+	}
+)
+
+// RegisterCompressor makes a compression type available to the writers,
+// or replaces the compressor of an existing one.  The GELF server has to
+// understand the resulting payloads.
+func RegisterCompressor(compressionType CompressType, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[compressionType] = c
+}
+
+// compress compresses a serialized message with the given compression
+// type and level, as it is sent over UDP.
+func compress(mBytes []byte, compressionType CompressType, level int) (zBytes []byte, err error) {
+	compressorsMu.RLock()
+	c, ok := compressors[compressionType]
+	compressorsMu.RUnlock()
+	if !ok {
+		panic(fmt.Sprintf("unknown compression type %d", compressionType))
+	}
+
+	var zBuf bytes.Buffer
+	zw, err := c(&zBuf, level)
 	if err != nil {
 		return
 	}
 	if _, err = zw.Write(mBytes); err != nil {
 		return
 	}
-	zw.Close()
+	if err = zw.Close(); err != nil {
+		return
+	}
+
+	return zBuf.Bytes(), nil
+}
 
-	zBytes := zBuf.Bytes()
-	if numChunks(zBytes) > 1 {
+// send writes the compressed message to the connection, chunking it
+// if it doesn't fit in a single datagram.
+func (w *udpTransport) send(zBytes []byte) (err error) {
+	if w.sendMu != nil {
+		w.sendMu.Lock()
+		defer w.sendMu.Unlock()
+	}
+	if numChunksOf(zBytes, w.size()) > 1 {
 		return w.writeChunked(zBytes)
 	}
 
@@ -101,6 +300,31 @@ func (w *udpTransport) WriteMessage(m *Message) (err error) {
 	return nil
 }
 
+// checkMagic verifies that a payload starts with the magic bytes of
+// the compression type it is supposed to be compressed with.  Uncompressed
+// payloads must start like a JSON object.
+func checkMagic(compressionType CompressType, zBytes []byte) error {
+	var magic []byte
+	switch compressionType {
+	case CompressGzip:
+		magic = magicGzip
+	case CompressZlib:
+		magic = magicZlib
+	case NoCompress:
+		magic = []byte{'{'}
+	default:
+		return nil // registered compressors have no known magic
+	}
+	if !bytes.HasPrefix(zBytes, magic) {
+		head := zBytes
+		if len(head) > len(magic) {
+			head = head[:len(magic)]
+		}
+		return fmt.Errorf("payload doesn't match compression type %d: %x", compressionType, head)
+	}
+	return nil
+}
+
 // writes the gzip compressed byte array to the connection as a series
 // of GELF chunked messages.  The header format is documented at
 // https://github.com/Graylog2/graylog2-docs/wiki/GELF as:
@@ -108,9 +332,9 @@ func (w *udpTransport) WriteMessage(m *Message) (err error) {
 //     2-byte magic (0x1e 0x0f), 8 byte id, 1 byte sequence id, 1 byte
 //     total, chunk-data
 func (w *udpTransport) writeChunked(zBytes []byte) (err error) {
-	b := make([]byte, 0, ChunkSize)
-	buf := bytes.NewBuffer(b)
-	nChunksI := numChunks(zBytes)
+	chunkSize := w.size()
+	dataLen := chunkSize - chunkedHeaderLen
+	nChunksI := numChunksOf(zBytes, chunkSize)
 	if nChunksI > 255 {
 		return fmt.Errorf("msg too large, would need %d chunks", nChunksI)
 	}
@@ -122,35 +346,30 @@ func (w *udpTransport) writeChunked(zBytes []byte) (err error) {
 		return fmt.Errorf("rand.Reader: %d/%s", n, err)
 	}
 
+	if debugAssertions {
+		if err := checkMagic(w.compressionType(), zBytes); err != nil {
+			return err
+		}
+	}
+
 	bytesLeft := len(zBytes)
+	chunks := make([][]byte, nChunks)
 	for i := uint8(0); i < nChunks; i++ {
-		buf.Reset()
-		// manually write header.  Don't care about
-		// host/network byte order, because the spec only
-		// deals in individual bytes.
-		buf.Write(magicChunked) //magic
-		buf.Write(msgId)
-		buf.WriteByte(i)
-		buf.WriteByte(nChunks)
 		// slice out our chunk from zBytes
-		chunkLen := chunkedDataLen
+		chunkLen := dataLen
 		if chunkLen > bytesLeft {
 			chunkLen = bytesLeft
 		}
-		off := int(i) * chunkedDataLen
-		chunk := zBytes[off : off+chunkLen]
-		buf.Write(chunk)
+		off := int(i) * dataLen
 
-		// write this chunk, and make sure the write was good
-		n, err := w.conn.Write(buf.Bytes())
-		if err != nil {
-			return fmt.Errorf("Write (chunk %d/%d): %s", i,
-				nChunks, err)
-		}
-		if n != len(buf.Bytes()) {
-			return fmt.Errorf("Write len: (chunk %d/%d) (%d/%d)",
-				i, nChunks, n, len(buf.Bytes()))
-		}
+		// manually write header.  Don't care about
+		// host/network byte order, because the spec only
+		// deals in individual bytes.
+		chunk := make([]byte, 0, chunkedHeaderLen+chunkLen)
+		chunk = append(chunk, magicChunked...) //magic
+		chunk = append(chunk, msgId...)
+		chunk = append(chunk, i, nChunks)
+		chunks[i] = append(chunk, zBytes[off:off+chunkLen]...)
 
 		bytesLeft -= chunkLen
 	}
@@ -158,5 +377,118 @@ func (w *udpTransport) writeChunked(zBytes []byte) (err error) {
 	if bytesLeft != 0 {
 		return fmt.Errorf("error: %d bytes left after sending", bytesLeft)
 	}
+
+	if p := w.parallelism(); p > 1 {
+		return w.writeParallel(chunks, p)
+	}
+	delay := w.delay()
+	for i, chunk := range chunks {
+		if i > 0 && delay > 0 {
+			sleep(delay)
+		}
+		if err := w.writeChunkChecked(w.conn, chunk, i, len(chunks)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// sleep is time.Sleep, replaced in tests.
+var sleep = time.Sleep
+
+// delay returns the pause between the chunks of a message.
+func (w *udpTransport) delay() time.Duration {
+	if w.chunkDelay == nil {
+		return 0
+	}
+	return w.chunkDelay()
+}
+
+// writeChunkChecked writes a chunk to conn, and makes sure the write was
+// good.
+func (w *udpTransport) writeChunkChecked(conn io.Writer, chunk []byte, index, total int) error {
+	n, err := w.writeChunk(conn, chunk, index, total)
+	if err != nil {
+		return fmt.Errorf("Write (chunk %d/%d): %s", index, total, err)
+	}
+	if n != len(chunk) {
+		return fmt.Errorf("Write len: (chunk %d/%d) (%d/%d)", index, total, n, len(chunk))
+	}
+	return nil
+}
+
+// parallelism returns how many chunks of a message may be written
+// concurrently.
+func (w *udpTransport) parallelism() int {
+	if w.parallelChunks == nil {
+		return 1
+	}
+	return w.parallelChunks()
+}
+
+// writeParallel writes the chunks of a message concurrently, at most p
+// at a time, on an unconnected socket: Graylog reassembles the chunks in
+// whatever order they arrive.  Unix datagram sockets write them on the
+// connected socket instead, an unconnected one needing a path of its own
+// to send from.  It returns the first error, once every chunk was written
+// or failed.
+func (w *udpTransport) writeParallel(chunks [][]byte, p int) error {
+	var dst io.Writer = w.conn
+	if w.conn.RemoteAddr().Network() != "unixgram" {
+		conn, err := w.packetConn(p)
+		if err != nil {
+			return err
+		}
+		dst = packetWriter{conn, w.conn.RemoteAddr()}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, p)
+	for i, chunk := range chunks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, chunk []byte) {
+			defer func() { <-sem; wg.Done() }()
+			if err := w.writeChunkChecked(dst, chunk, i, len(chunks)); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(i, chunk)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// packetConn returns the unconnected socket of parallel writes, opening
+// it on first use with a send buffer holding p chunks, so that the
+// concurrent writes don't overflow it.
+func (w *udpTransport) packetConn(p int) (net.PacketConn, error) {
+	w.pcMu.Lock()
+	defer w.pcMu.Unlock()
+	if w.pc != nil {
+		return w.pc, nil
+	}
+
+	pc, err := net.ListenPacket(w.conn.RemoteAddr().Network(), "")
+	if err != nil {
+		return nil, err
+	}
+	if uc, ok := pc.(*net.UDPConn); ok {
+		uc.SetWriteBuffer(2 * p * w.size())
+	}
+	w.pc = pc
+	return pc, nil
+}
+
+// packetWriter writes datagrams to addr.
+type packetWriter struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+func (pw packetWriter) Write(b []byte) (int, error) {
+	return pw.conn.WriteTo(b, pw.addr)
+}
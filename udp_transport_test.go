@@ -0,0 +1,526 @@
+package graylog
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRawUDPTransport returns a UDP transport connected to a listener
+// which reads the datagrams it sends as they are, without decoding them.
+func newRawUDPTransport(t *testing.T, compressionType CompressType) (*udpTransport, net.PacketConn) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	conn, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	return &udpTransport{
+		conn:             conn,
+		compressionType:  func() CompressType { return compressionType },
+		compressionLevel: func(int) int { return flate.BestSpeed },
+	}, l
+}
+
+// maxChunkedLen is the largest payload that fits in the 255 chunks of
+// ChunkSize allowed by GELF.
+const maxChunkedLen = 255*(ChunkSize-chunkedHeaderLen) - 1
+
+func largeMessage(n int) *Message {
+	raw := make([]byte, n)
+	rand.Read(raw)
+	return &Message{Version: "1.1", Host: "testing.local", Short: hex.EncodeToString(raw)}
+}
+
+func TestChunkedMagic(t *testing.T) {
+	for _, ct := range []CompressType{CompressGzip, CompressZlib, NoCompress} {
+		udp, l := newRawUDPTransport(t, ct)
+
+		if err := udp.WriteMessage(largeMessage(2 * ChunkSize)); err != nil {
+			t.Fatalf("compression %d: WriteMessage: %s", ct, err)
+		}
+
+		buf := make([]byte, ChunkSize)
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %s", err)
+		}
+		if buf[0] != magicChunked[0] || buf[1] != magicChunked[1] || buf[10] != 0 {
+			t.Fatalf("compression %d: expected first chunk, got header %x", ct, buf[:chunkedHeaderLen])
+		}
+		if err := checkMagic(ct, buf[chunkedHeaderLen:n]); err != nil {
+			t.Errorf("compression %d: %s", ct, err)
+		}
+
+		l.Close()
+		udp.conn.Close()
+	}
+}
+
+func TestCheckMagicMismatch(t *testing.T) {
+	zBytes, err := compress([]byte(`{"version":"1.1"}`), CompressZlib, flate.BestSpeed)
+	if err != nil {
+		t.Fatalf("compress: %s", err)
+	}
+	if checkMagic(CompressGzip, zBytes) == nil {
+		t.Error("zlib payload should not pass as gzip")
+	}
+	if checkMagic(NoCompress, zBytes) == nil {
+		t.Error("zlib payload should not pass as uncompressed")
+	}
+}
+
+func TestTooLargeBeforeCompression(t *testing.T) {
+	udp, l := newRawUDPTransport(t, CompressGzip)
+	defer l.Close()
+	compressions := 0
+	udp.compressionLevel = func(int) int {
+		compressions++
+		return flate.BestSpeed
+	}
+	udp.maxUncompressedSize = func() int { return 64 * 1024 }
+
+	if err := udp.WriteMessage(largeMessage(64 * 1024)); err != ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+	if compressions != 0 {
+		t.Errorf("message should be rejected before compression, compressed %d times", compressions)
+	}
+
+	if err := udp.WriteMessage(largeMessage(ChunkSize)); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+	}
+	if compressions != 1 {
+		t.Errorf("message under the limit should be compressed, compressed %d times", compressions)
+	}
+}
+
+func TestTooLargeUncompressed(t *testing.T) {
+	udp, l := newRawUDPTransport(t, NoCompress)
+	defer l.Close()
+
+	if err := udp.WriteMessage(largeMessage(maxChunkedLen / 2)); err != ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+// upperCompressor "compresses" by upper-casing the payload.
+type upperCompressor struct {
+	w io.Writer
+}
+
+func (c upperCompressor) Write(p []byte) (int, error) {
+	return c.w.Write(bytes.ToUpper(p))
+}
+
+func (c upperCompressor) Close() error {
+	return nil
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	const CompressUpper CompressType = 100
+	calls := 0
+	RegisterCompressor(CompressUpper, func(w io.Writer, level int) (io.WriteCloser, error) {
+		calls++
+		return upperCompressor{w}, nil
+	})
+
+	w, _ := newCaptureWriter()
+	w.CompressionType = CompressUpper
+	b, err := w.Encode(&Message{Version: "1.1", Short: "message"})
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if calls != 1 {
+		t.Errorf("custom compressor should be invoked once, got %d calls", calls)
+	}
+	if !bytes.Contains(b, []byte(`"SHORT_MESSAGE":"MESSAGE"`)) {
+		t.Errorf("payload should be compressed by the custom compressor, got %s", b)
+	}
+
+	// built-in compressors stay registered
+	if b, err = compress([]byte("{}"), CompressGzip, flate.BestSpeed); err != nil || !bytes.HasPrefix(b, magicGzip) {
+		t.Errorf("gzip should still be registered, got %x, %v", b, err)
+	}
+}
+
+func TestChunkWriterDrop(t *testing.T) {
+	udp, l := newRawUDPTransport(t, NoCompress)
+	defer l.Close()
+	defer udp.conn.Close()
+
+	written, dropped, total := 0, 0, 0
+	cw := ChunkWriterFunc(func(conn io.Writer, chunk []byte, index, n int) (int, error) {
+		total = n
+		if index%2 == 1 {
+			dropped++
+			return len(chunk), nil
+		}
+		written++
+		return conn.Write(chunk)
+	})
+	udp.chunkWriter = func() ChunkWriter { return cw }
+
+	if err := udp.WriteMessage(largeMessage(3 * ChunkSize)); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if total < 4 || written+dropped != total || dropped != total/2 {
+		t.Fatalf("expected every other of the %d chunks dropped, wrote %d and dropped %d", total, written, dropped)
+	}
+
+	buf := make([]byte, ChunkSize)
+	for i := 0; i < written; i++ {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := l.ReadFrom(buf); err != nil {
+			t.Fatalf("ReadFrom: %s", err)
+		}
+		if index := int(buf[10]); index%2 != 0 {
+			t.Errorf("chunk %d should have been dropped", index)
+		}
+	}
+	l.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := l.ReadFrom(buf); err == nil {
+		t.Error("only the chunks written should be received")
+	}
+}
+
+func TestChunkWriterError(t *testing.T) {
+	udp, l := newRawUDPTransport(t, NoCompress)
+	defer l.Close()
+	defer udp.conn.Close()
+
+	errDropped := errors.New("dropped")
+	udp.chunkWriter = func() ChunkWriter {
+		return ChunkWriterFunc(func(conn io.Writer, chunk []byte, index, n int) (int, error) {
+			if index == 1 {
+				return 0, errDropped
+			}
+			return conn.Write(chunk)
+		})
+	}
+
+	err := udp.WriteMessage(largeMessage(3 * ChunkSize))
+	if err == nil || !strings.Contains(err.Error(), "chunk 1/") || !strings.Contains(err.Error(), "dropped") {
+		t.Errorf("expected the chunk error, got %v", err)
+	}
+}
+
+func TestStartProbe(t *testing.T) {
+	// find a port nobody listens on
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	w, err := NewWriter(addr)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	errs := make(chan error, 10)
+	w.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	stop := w.StartProbe(10 * time.Millisecond)
+	defer stop()
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "refused") {
+			t.Errorf("expected connection refused, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("probe should surface the unreachable port")
+	}
+}
+
+func TestStartProbeNotUDP(t *testing.T) {
+	w := NewConsoleWriter(ioutil.Discard)
+	w.StartProbe(time.Millisecond)()
+}
+
+func TestOnEncoded(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	var encoded []byte
+	w.OnEncoded = func(compressed []byte) {
+		encoded = append([]byte(nil), compressed...)
+	}
+	if _, err := w.Write([]byte("encoded\nand sent")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	sent, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %s", err)
+	}
+	var m Message
+	if err := json.NewDecoder(zr).Decode(&m); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if m.Short != "encoded" || m.Full != sent.Full || m.TimeUnix != sent.TimeUnix {
+		t.Errorf("expected the bytes sent, got %+v", m)
+	}
+}
+
+func TestNetworkUDP4(t *testing.T) {
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.LocalAddr().String())
+
+	w, err := NewWriter("udp4://localhost:" + port)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	if w.network != "udp4" {
+		t.Errorf("expected the udp4 network, got %q", w.network)
+	}
+	conn := w.Transport.(*udpTransport).conn
+	if ip := conn.RemoteAddr().(*net.UDPAddr).IP; ip.To4() == nil {
+		t.Errorf("expected an IPv4 connection, got %s", ip)
+	}
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; ip.To4() == nil {
+		t.Errorf("expected an IPv4 local address, got %s", ip)
+	}
+}
+
+func TestCompressionAcrossChunkBoundary(t *testing.T) {
+	udp, l := newRawUDPTransport(t, CompressGzip)
+	defer l.Close()
+	defer udp.conn.Close()
+
+	// find messages compressing to just under and just over a datagram,
+	// from text which compresses like logs do
+	rnd := mathrand.New(mathrand.NewSource(1))
+	var text bytes.Buffer
+	var under, over *Message
+	for over == nil {
+		if text.Len() > 100*ChunkSize {
+			t.Fatal("no message compressing just over a datagram")
+		}
+		fmt.Fprintf(&text, "request %d took %dms for user %d\n", rnd.Intn(1000000), rnd.Intn(1000), rnd.Intn(10000))
+		m := &Message{Version: "1.1", Host: "testing.local", Short: text.String()}
+		mBytes, _ := json.Marshal(m)
+		zBytes, err := udp.compress(mBytes)
+		if err != nil {
+			t.Fatalf("compress: %s", err)
+		}
+		if numChunks(zBytes) == 1 {
+			under = m
+		} else if under != nil {
+			over = m
+		}
+	}
+
+	for _, m := range []*Message{under, over} {
+		if err := udp.WriteMessage(m); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+
+		var payload []byte
+		buf := make([]byte, 2*ChunkSize)
+		for chunks, total := 0, 1; chunks < total; chunks++ {
+			l.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := l.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("ReadFrom: %s", err)
+			}
+			if bytes.HasPrefix(buf, magicChunked) {
+				total = int(buf[11])
+				payload = append(payload, buf[chunkedHeaderLen:n]...)
+			} else {
+				payload = append(payload, buf[:n]...)
+			}
+		}
+
+		if err := checkMagic(CompressGzip, payload); err != nil {
+			t.Fatalf("%d bytes message: %s", len(m.Short), err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("gzip.NewReader: %s", err)
+		}
+		var got Message
+		if err := json.NewDecoder(zr).Decode(&got); err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		if got.Short != m.Short {
+			t.Errorf("%d bytes message: decompressed message differs", len(m.Short))
+		}
+	}
+}
+
+func TestParallelChunks(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.ParallelChunks = 4
+
+	m := largeMessage(20 * ChunkSize)
+	if err := w.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if w.Transport.(*udpTransport).pc == nil {
+		t.Error("chunks should be written from the unconnected socket")
+	}
+
+	received, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if received.Short != m.Short {
+		t.Errorf("message should be reassembled, got %d bytes out of %d", len(received.Short), len(m.Short))
+	}
+}
+
+func TestChunkDelay(t *testing.T) {
+	defer func(f func(time.Duration)) { sleep = f }(sleep)
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	udp, l := newRawUDPTransport(t, NoCompress)
+	defer l.Close()
+	udp.chunkDelay = func() time.Duration { return 50 * time.Microsecond }
+
+	m := largeMessage(ChunkSize)
+	if err := udp.WriteMessage(m); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	b, _ := json.Marshal(m)
+	if len(delays) != numChunks(b)-1 {
+		t.Errorf("expected a delay between each of the %d chunks, got %v", numChunks(b), delays)
+	}
+	for _, d := range delays {
+		if d != 50*time.Microsecond {
+			t.Errorf("expected the configured delay, got %s", d)
+		}
+	}
+
+	delays = nil
+	udp.WriteMessage(&Message{Version: "1.1", Short: "small"})
+	if len(delays) != 0 {
+		t.Errorf("unchunked messages should not be delayed, got %v", delays)
+	}
+}
+
+func TestWritingToUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-unixgram")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gelf.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram: %s", err)
+	}
+	r := &Reader{conn: conn}
+	defer conn.Close()
+
+	w, err := NewWriter("unixgram://" + path)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	if w.network != "unixgram" {
+		t.Errorf("expected the unixgram network, got %q", w.network)
+	}
+
+	large := largeMessage(4 * ChunkSize)
+	for _, m := range []*Message{{Version: "1.1", Host: "testing.local", Short: "local shipper"}, large} {
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		got, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if got.Short != m.Short {
+			t.Errorf("expected the message back, got %d bytes", len(got.Short))
+		}
+	}
+	if b, _ := w.Encode(large); numChunks(b) < 2 {
+		t.Errorf("the large message should have been chunked")
+	}
+}
+
+func TestParallelChunksUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graylog-unixgram")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gelf.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram: %s", err)
+	}
+	r := &Reader{conn: conn}
+	defer conn.Close()
+
+	w, err := NewWriter("unixgram://" + path)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.ParallelChunks = 4
+
+	large := largeMessage(4 * ChunkSize)
+	if err := w.WriteMessage(large); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	got, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if got.Short != large.Short {
+		t.Errorf("expected the message back, got %d bytes", len(got.Short))
+	}
+	if w.Transport.(*udpTransport).pc != nil {
+		t.Errorf("the chunks should be written on the connected socket")
+	}
+}
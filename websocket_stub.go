@@ -0,0 +1,17 @@
+//go:build !gelfwebsocket
+// +build !gelfwebsocket
+
+package graylog
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// newWSTransport refuses WebSocket addresses, build with -tags
+// gelfwebsocket to support them.
+func newWSTransport(addr string, dial func(network, addr string) (net.Conn, error), tlsConfig func() *tls.Config, timeout func() time.Duration) (Transport, error) {
+	return nil, errors.New("gelf: ws:// and wss:// need a build with -tags gelfwebsocket")
+}
@@ -0,0 +1,268 @@
+//go:build gelfwebsocket
+// +build gelfwebsocket
+
+package graylog
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the key suffix of the opening handshake, RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC11B85"
+
+// wsMinBackoff and wsMaxBackoff bound the delay between redials of a
+// dropped WebSocket connection, doubled on every failed dial.
+var (
+	wsMinBackoff = 100 * time.Millisecond
+	wsMaxBackoff = 30 * time.Second
+)
+
+// wsTransport sends messages to a WebSocket collector, each as a text
+// frame holding the JSON message.  A failed connection is dropped, and
+// dialed again on a later send, with backoff while dials fail.  It is a
+// minimal RFC 6455 client: it never reads what the server sends.
+type wsTransport struct {
+	mu      sync.Mutex
+	url     *url.URL
+	conn    net.Conn
+	closed  bool
+	backoff time.Duration
+	retryAt time.Time
+	dialErr error
+
+	// pending is the connection dialed by newWSTransport for wss, not
+	// secured yet.
+	pending net.Conn
+
+	dial      func(network, addr string) (net.Conn, error)
+	tlsConfig func() *tls.Config
+	timeout   func() time.Duration
+}
+
+// newWSTransport returns a transport to the WebSocket collector at addr,
+// connected right away.  For wss, only the TCP connection is, the TLS
+// and opening handshakes happening before the first message, so that
+// the configuration returned by tlsConfig can be set after the transport
+// is created, as for tls://.  The TLS handshake must complete within the
+// duration returned by timeout.
+func newWSTransport(addr string, dial func(network, addr string) (net.Conn, error), tlsConfig func() *tls.Config, timeout func() time.Duration) (*wsTransport, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &wsTransport{url: u, dial: dial, tlsConfig: tlsConfig, timeout: timeout}
+	if u.Scheme == "wss" {
+		t.pending, err = t.dial("tcp", t.host())
+	} else {
+		t.conn, err = t.connect()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// host returns the address of the collector, on the default port of the
+// scheme if the URL has none.
+func (t *wsTransport) host() string {
+	if t.url.Port() != "" {
+		return t.url.Host
+	}
+	if t.url.Scheme == "wss" {
+		return net.JoinHostPort(t.url.Hostname(), "443")
+	}
+	return net.JoinHostPort(t.url.Hostname(), "80")
+}
+
+// connect dials the collector, unless newWSTransport did, and performs
+// the TLS handshake for wss and the opening handshake.
+func (t *wsTransport) connect() (net.Conn, error) {
+	conn := t.pending
+	t.pending = nil
+	if conn == nil {
+		var err error
+		if conn, err = t.dial("tcp", t.host()); err != nil {
+			return nil, err
+		}
+	}
+	if t.url.Scheme == "wss" {
+		tc, err := t.secure(conn)
+		if err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	if err := t.handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// secure performs the TLS handshake over conn, with the TLS settings of
+// the writer, closing it if the handshake fails or times out.  The
+// server name defaults to the host of the URL.
+func (t *wsTransport) secure(conn net.Conn) (net.Conn, error) {
+	config := &tls.Config{}
+	if c := t.tlsConfig(); c != nil {
+		config = c.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = t.url.Hostname()
+	}
+
+	if d := t.timeout(); d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("gelf: TLS handshake with %s: %s", t.host(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// handshake upgrades the HTTP connection conn to a WebSocket.
+func (t *wsTransport) handshake(conn net.Conn) error {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	u := *t.url
+	u.Scheme = "http"
+	if t.url.Scheme == "wss" {
+		u.Scheme = "https"
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("gelf: WebSocket handshake with %s: %s", t.url.Host, resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return fmt.Errorf("gelf: WebSocket handshake with %s: bad Sec-WebSocket-Accept", t.url.Host)
+	}
+	return nil
+}
+
+// WriteMessage sends the specified message as a text frame.
+func (t *wsTransport) WriteMessage(m *Message) (err error) {
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+	if t.conn == nil {
+		if time.Now().Before(t.retryAt) {
+			return t.dialErr
+		}
+		if t.conn, err = t.connect(); err != nil {
+			t.conn = nil
+			t.backoff *= 2
+			if t.backoff < wsMinBackoff {
+				t.backoff = wsMinBackoff
+			} else if t.backoff > wsMaxBackoff {
+				t.backoff = wsMaxBackoff
+			}
+			t.retryAt = time.Now().Add(t.backoff)
+			t.dialErr = err
+			return
+		}
+		t.backoff = 0
+	}
+
+	if err = writeFrame(t.conn, 0x1, mBytes); err != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	return
+}
+
+// writeFrame writes a single masked frame of the given opcode, as
+// clients must mask their frames.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	n, err := w.Write(frame)
+	if err == nil && n != len(frame) {
+		err = fmt.Errorf("bad write (%d/%d)", n, len(frame))
+	}
+	return err
+}
+
+// Close sends a close frame and closes the connection, which isn't
+// dialed again.
+func (t *wsTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	if t.pending != nil {
+		t.pending.Close()
+		t.pending = nil
+	}
+	if t.conn == nil {
+		return nil
+	}
+	writeFrame(t.conn, 0x8, nil)
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
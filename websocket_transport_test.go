@@ -0,0 +1,223 @@
+//go:build gelfwebsocket
+// +build gelfwebsocket
+
+package graylog
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsServer accepts WebSocket connections and decodes the text frames
+// sent over them as messages.
+type wsServer struct {
+	*httptest.Server
+	msgs  chan *Message
+	conns chan net.Conn
+}
+
+func newWSServer(t *testing.T) *wsServer {
+	s := newUnstartedWSServer(t)
+	s.Start()
+	return s
+}
+
+// newWSSServer returns a wsServer over TLS, with the pool trusting its
+// certificate.
+func newWSSServer(t *testing.T) (*wsServer, *x509.CertPool) {
+	s := newUnstartedWSServer(t)
+	s.StartTLS()
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	return s, pool
+}
+
+func newUnstartedWSServer(t *testing.T) *wsServer {
+	s := &wsServer{msgs: make(chan *Message, 16), conns: make(chan net.Conn, 4)}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" || req.URL.Path != "/gelf" {
+			http.Error(rw, "not a websocket", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %s", err)
+			return
+		}
+		sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+		buf.Flush()
+		s.conns <- conn
+		go s.serve(t, conn, buf.Reader)
+	}))
+	return s
+}
+
+func (s *wsServer) serve(t *testing.T, conn net.Conn, r *bufio.Reader) {
+	defer conn.Close()
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return
+		}
+		if head[1]&0x80 == 0 {
+			t.Errorf("client frames must be masked")
+			return
+		}
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(r, ext[:])
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(r, ext[:])
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		var mask [4]byte
+		io.ReadFull(r, mask[:])
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch head[0] {
+		case 0x81:
+			var m Message
+			if err := json.Unmarshal(payload, &m); err != nil {
+				t.Errorf("Unmarshal: %s", err)
+			}
+			s.msgs <- &m
+		case 0x88:
+			return
+		default:
+			t.Errorf("unexpected frame %#x", head[0])
+		}
+	}
+}
+
+func (s *wsServer) receive(t *testing.T) *Message {
+	select {
+	case m := <-s.msgs:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no frame received")
+		return nil
+	}
+}
+
+func TestWritingToWebSocket(t *testing.T) {
+	s := newWSServer(t)
+	defer s.Close()
+
+	w, err := NewWriter("ws://" + s.Listener.Addr().String() + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	msgData := "words\n\tand more"
+	if _, err := w.Write([]byte(msgData)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if m := s.receive(t); m.Short != "words" || m.Full != msgData {
+		t.Errorf("unexpected message: %+v", m)
+	}
+
+	long := strings.Repeat("x", 70000)
+	if _, err := w.Write([]byte(long)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if m := s.receive(t); m.Short != long {
+		t.Errorf("expected the long message in a single frame, got %d bytes", len(m.Short))
+	}
+}
+
+func TestWebSocketReconnect(t *testing.T) {
+	defer func(d time.Duration) { wsMinBackoff = d }(wsMinBackoff)
+	wsMinBackoff = 10 * time.Millisecond
+
+	s := newWSServer(t)
+	defer s.Close()
+
+	w, err := NewWriter("ws://" + s.Listener.Addr().String() + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	(<-s.conns).Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w.Write([]byte("after the drop"))
+		select {
+		case m := <-s.msgs:
+			if m.Short != "after the drop" {
+				t.Errorf("unexpected message: %+v", m)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the connection wasn't dialed again")
+		}
+	}
+}
+
+func TestWebSocketBadHandshake(t *testing.T) {
+	s := newWSServer(t)
+	defer s.Close()
+
+	if _, err := NewWriter("ws://" + s.Listener.Addr().String() + "/other"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected the handshake refused, got %v", err)
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	s, pool := newWSSServer(t)
+	defer s.Close()
+
+	w, err := NewWriter("wss://" + s.Listener.Addr().String() + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	// set after NewWriter, as the handshake waits for the first message
+	w.RootCAs = pool
+	if _, err := w.Write([]byte("over wss")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if m := s.receive(t); m.Short != "over wss" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+}
+
+func TestWebSocketTLSUntrusted(t *testing.T) {
+	s, _ := newWSSServer(t)
+	defer s.Close()
+
+	w, err := NewWriter("wss://" + s.Listener.Addr().String() + "/gelf")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte("untrusted")); err == nil || !strings.HasPrefix(err.Error(), "gelf: TLS handshake with ") {
+		t.Errorf("expected the certificate refused, got %v", err)
+	}
+}